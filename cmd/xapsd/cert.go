@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal"
+)
+
+const certUsage = "usage: xapsd [flags] cert info [-json] [-days n]"
+
+// runCert executes the cert subcommands:
+//
+//	cert info   show the topic, validity and environments of the APNs credentials
+//
+// It fails if credentials can't be loaded or a certificate expires within
+// -days, which defaults to healthCertExpiryDays. With -days 0 it only fails
+// for expired certificates.
+func runCert(args []string) int {
+	if len(args) == 0 || args[0] != "info" {
+		fmt.Fprintln(os.Stderr, certUsage)
+		return exitUsage
+	}
+	flags := flag.NewFlagSet("cert info", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, certUsage)
+		flags.PrintDefaults()
+	}
+	asJson := flags.Bool("json", false, "print the credentials as JSON")
+	days := flags.Int("days", 0, "fail if a certificate expires within the days, 0 fails only for expired ones (default healthCertExpiryDays)")
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+		return exitUsage
+	}
+	cfg, ok := loadConfig()
+	if !ok {
+		return exitFailure
+	}
+	daysSet := false
+	flags.Visit(func(flag *flag.Flag) {
+		daysSet = daysSet || flag.Name == "days"
+	})
+	if !daysSet {
+		*days = int(cfg.HealthCertExpiryDays)
+	}
+
+	infos := internal.CertificateInfos(&cfg)
+	code := exitOk
+	for _, info := range infos {
+		if info.Error != "" || !info.TokenBased() && info.DaysLeft < *days {
+			code = exitFailure
+		}
+	}
+	if *asJson {
+		if printJson(infos) != exitOk {
+			return exitFailure
+		}
+		return code
+	}
+	for _, info := range infos {
+		printCertificateInfo(info, *days)
+	}
+	return code
+}
+
+func printCertificateInfo(info internal.CertificateInfo, days int) {
+	fmt.Println(info.Subtopic)
+	fmt.Println("  file:        ", info.File)
+	if info.TokenBased() {
+		fmt.Println("  auth:         token, key id", info.KeyId+", team id", info.TeamId)
+	}
+	if info.Topic != "" {
+		fmt.Println("  topic:       ", info.Topic)
+	}
+	if info.KeyType != "" {
+		fmt.Println("  key type:    ", info.KeyType)
+	}
+	if !info.NotAfter.IsZero() {
+		fmt.Println("  subject:     ", info.Subject)
+		fmt.Println("  issuer:      ", info.Issuer)
+		fmt.Println("  valid from:  ", info.NotBefore)
+		fmt.Println("  valid until: ", info.NotAfter)
+		expiry := fmt.Sprint(info.DaysLeft)
+		if info.DaysLeft < days {
+			expiry += fmt.Sprintf(" (less than %d)", days)
+		}
+		fmt.Println("  days left:   ", expiry)
+		environments := strings.Join(info.Environments, ", ")
+		if environments == "" {
+			environments = "unknown, no APNs environment extension"
+		}
+		fmt.Println("  environments:", environments)
+	}
+	if info.Error != "" {
+		fmt.Println("  error:       ", info.Error)
+	}
+}
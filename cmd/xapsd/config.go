@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+// runConfig executes the config subcommands and returns the exit code:
+//
+//	config check   validate the configuration
+//	config dump    print the effective configuration without secrets
+func runConfig(args []string) int {
+	if len(args) != 1 || (args[0] != "check" && args[0] != "dump") {
+		fmt.Fprintln(os.Stderr, "usage: xapsd [flags] config check|dump")
+		return exitUsage
+	}
+	config.ParseConfig(*configName, *configPath)
+	cfg := config.GetOptions()
+	err := cfg.Validate()
+
+	if args[0] == "dump" {
+		dump, dumpErr := cfg.Dump()
+		if dumpErr != nil {
+			fmt.Fprintln(os.Stderr, "Cannot dump the configuration:", dumpErr)
+			return exitFailure
+		}
+		fmt.Printf("# %s\n%s", configSource(), dump)
+	}
+	if err != nil {
+		printConfigErrors(err)
+		return exitFailure
+	}
+	if args[0] == "check" {
+		fmt.Println("The configuration of", configSource(), "is valid")
+	}
+	return exitOk
+}
+
+// printConfigErrors prints each error of the validation on its own line
+func printConfigErrors(err error) {
+	fmt.Fprintln(os.Stderr, "Invalid configuration of", configSource()+":")
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		for _, err := range joined.Unwrap() {
+			fmt.Fprintln(os.Stderr, "  "+err.Error())
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "  "+err.Error())
+}
+
+// configSource describes where the configuration has been read from
+func configSource() string {
+	if config.FileUsed() == "" {
+		return "the environment and flags"
+	}
+	return config.FileUsed() + ", the environment and flags"
+}
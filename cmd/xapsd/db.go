@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+)
+
+const dbUsage = `usage: xapsd [flags] db <command>
+
+  list [search]                     list users matching username, account id or device token
+  show <username>                   show a single user
+  delete <username> [account-id]    delete all registrations of a user or a single one
+  delete-device <token>             delete all registrations of a device token
+  cleanup                           delete registrations not renewed within 30 days
+
+xapsd keeps the database in memory and overwrites the file, stop it before
+changing the database or use the admin API instead.`
+
+// runDb executes the db subcommands on the database file of the configuration
+func runDb(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, dbUsage)
+		return exitUsage
+	}
+	valid := map[string]bool{"list": len(args) <= 2, "show": len(args) == 2, "delete": len(args) == 2 || len(args) == 3,
+		"delete-device": len(args) == 2, "cleanup": len(args) == 1}
+	if !valid[args[0]] {
+		fmt.Fprintln(os.Stderr, dbUsage)
+		return exitUsage
+	}
+	cfg, ok := loadConfig()
+	if !ok {
+		return exitFailure
+	}
+	db, err := database.NewDatabase(cfg.DatabaseFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot open database:", err)
+		return exitFailure
+	}
+
+	switch args[0] {
+	case "list":
+		search := ""
+		if len(args) == 2 {
+			search = args[1]
+		}
+		return printJson(db.SearchUsers(search))
+	case "show":
+		name, ok := canonicalUsername(&cfg, args[1])
+		if !ok {
+			return exitFailure
+		}
+		user, ok := db.GetUser(name)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "Unknown user", name)
+			return exitFailure
+		}
+		return printJson(user)
+	case "delete":
+		name, ok := canonicalUsername(&cfg, args[1])
+		if !ok {
+			return exitFailure
+		}
+		var deleted []database.Registration
+		if len(args) == 3 {
+			if registration, ok := db.DeleteRegistration(name, args[2]); ok {
+				deleted = append(deleted, registration)
+			}
+		} else {
+			deleted = db.DeleteUser(name)
+		}
+		return printDeleted(len(deleted))
+	case "delete-device":
+		return printDeleted(len(db.DeleteDeviceToken(args[1])))
+	default:
+		fmt.Println("Deleted", db.Cleanup(), "registrations")
+		return exitOk
+	}
+}
+
+// canonicalUsername applies the username canonicalization of the
+// configuration like the daemon does
+func canonicalUsername(cfg *config.Config, name string) (string, bool) {
+	usernames, err := username.NewCanonicalizer(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot setup username canonicalization:", err)
+		return "", false
+	}
+	canonical, err := usernames.Canonicalize(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid username:", err)
+		return "", false
+	}
+	return canonical, true
+}
+
+// printDeleted fails if no registration has been deleted
+func printDeleted(deleted int) int {
+	fmt.Println("Deleted", deleted, "registrations")
+	if deleted == 0 {
+		return exitFailure
+	}
+	return exitOk
+}
+
+func printJson(v interface{}) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot print result:", err)
+		return exitFailure
+	}
+	return exitOk
+}
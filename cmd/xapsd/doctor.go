@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal"
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/sideshow/apns2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	doctorUsage = "usage: xapsd [flags] doctor [-offline]"
+
+	findingOk   = "ok"
+	findingWarn = "warn"
+	findingFail = "fail"
+	findingSkip = "skip"
+
+	// user running the daemon in configs/systemd/xapsd.service
+	serviceUser = "xapsd"
+	// timeout of the DNS lookup and the connection to APNs
+	apnsDialTimeout = 5 * time.Second
+)
+
+// serviceWritablePaths are writable by the daemon with ProtectSystem=strict,
+// see ReadWritePaths and RuntimeDirectory of configs/systemd/xapsd.service
+var serviceWritablePaths = []string{"/var/lib/xapsd", "/run/xapsd"}
+
+// finding is the outcome of a check of doctor, hint tells how to fix it
+type finding struct {
+	status  string
+	check   string
+	message string
+	hint    string
+}
+
+// runDoctor checks the setup of xapsd and prints a finding for each check.
+// It fails if any check failed, warnings don't change the exit code.
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, doctorUsage)
+		flags.PrintDefaults()
+	}
+	offline := flags.Bool("offline", false, "skip the checks requiring internet access")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return exitUsage
+	}
+
+	config.ParseConfig(*configName, *configPath)
+	cfg := config.GetOptions()
+	var findings []finding
+	if err := cfg.Validate(); err != nil {
+		var joined interface{ Unwrap() []error }
+		errs := []error{err}
+		if errors.As(err, &joined) {
+			errs = joined.Unwrap()
+		}
+		for _, err := range errs {
+			findings = append(findings, finding{findingFail, "config", err.Error(), "fix the option, xapsd config check lists all errors"})
+		}
+		return printFindings(findings)
+	}
+	// the findings report the problems, the log would repeat them
+	log.SetLevel(log.WarnLevel)
+
+	findings = append(findings, finding{status: findingOk, check: "config", message: "valid, read from " + configSource()})
+	findings = append(findings, checkDatabaseFile(&cfg)...)
+	findings = append(findings, checkCredentials(&cfg)...)
+	findings = append(findings, checkListeners(&cfg)...)
+	if *offline {
+		findings = append(findings, finding{status: findingSkip, check: "apns", message: "skipped by -offline"})
+	} else {
+		findings = append(findings, checkApnsReachable())
+	}
+	if outcome, err := internal.Roundtrip(&cfg); err != nil {
+		findings = append(findings, finding{findingFail, "roundtrip", err.Error(), "check the notificationPolicy, rateLimits and username options"})
+	} else {
+		findings = append(findings, finding{status: findingOk, check: "roundtrip", message: outcome})
+	}
+	return printFindings(findings)
+}
+
+func printFindings(findings []finding) int {
+	code := exitOk
+	for _, finding := range findings {
+		fmt.Printf("%-5s %-12s %s\n", finding.status, finding.check, finding.message)
+		if finding.hint != "" {
+			fmt.Printf("%-18s hint: %s\n", "", finding.hint)
+		}
+		if finding.status == findingFail {
+			code = exitFailure
+		}
+	}
+	return code
+}
+
+// checkDatabaseFile checks that the database can be read and replaced by
+// the daemon, also when running as systemd service
+func checkDatabaseFile(cfg *config.Config) []finding {
+	const check = "database"
+	dir := filepath.Dir(cfg.DatabaseFile)
+	var findings []finding
+	if _, err := os.Stat(dir); err != nil {
+		return []finding{{findingFail, check, err.Error(), fmt.Sprintf("create %s owned by the %s user", dir, serviceUser)}}
+	}
+
+	data, err := os.ReadFile(cfg.DatabaseFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		findings = append(findings, finding{status: findingWarn, check: check, message: cfg.DatabaseFile + " does not exist yet, it is created at the start"})
+	case err != nil:
+		findings = append(findings, finding{findingFail, check, err.Error(), "make the file readable by the " + serviceUser + " user"})
+	default:
+		var db struct {
+			Users map[string]json.RawMessage
+		}
+		if len(data) != 0 {
+			if err := json.Unmarshal(data, &db); err != nil {
+				findings = append(findings, finding{findingFail, check, cfg.DatabaseFile + " is corrupt: " + err.Error(), "restore the file from a backup"})
+				break
+			}
+		}
+		findings = append(findings, finding{status: findingOk, check: check, message: fmt.Sprintf("%s is readable, %d users", cfg.DatabaseFile, len(db.Users))})
+	}
+
+	// the database is replaced by writing a new file next to it
+	if f, err := os.CreateTemp(dir, filepath.Base(cfg.DatabaseFile)+".check"); err != nil {
+		findings = append(findings, finding{findingFail, check, dir + " is not writable: " + err.Error(), "make the directory writable by the " + serviceUser + " user"})
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+		findings = append(findings, finding{status: findingOk, check: check, message: dir + " is writable"})
+	}
+	if owner := ownerMismatch(dir); owner != "" {
+		findings = append(findings, finding{findingWarn, check, dir + " is owned by " + owner + " instead of " + serviceUser,
+			fmt.Sprintf("chown -R %s:%s %s if xapsd runs as systemd service", serviceUser, serviceUser, dir)})
+	}
+	if !serviceWritable(cfg.DatabaseFile) {
+		findings = append(findings, finding{findingWarn, check, cfg.DatabaseFile + " is read-only for the systemd service with ProtectSystem=strict",
+			"add " + dir + " to ReadWritePaths of xapsd.service"})
+	}
+	if cfg.LegacySocket != "" && !serviceWritable(cfg.LegacySocket) {
+		findings = append(findings, finding{findingWarn, "legacy", cfg.LegacySocket + " can't be created by the systemd service with ProtectSystem=strict",
+			"place the socket below /run/xapsd or add its directory to ReadWritePaths of xapsd.service"})
+	}
+	return findings
+}
+
+// ownerMismatch returns the owner of path if the service user exists and doesn't own it
+func ownerMismatch(path string) string {
+	service, err := user.Lookup(serviceUser)
+	if err != nil {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || strconv.Itoa(int(stat.Uid)) == service.Uid {
+		return ""
+	}
+	if owner, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+		return owner.Username
+	}
+	return "uid " + strconv.Itoa(int(stat.Uid))
+}
+
+// serviceWritable returns whether path can be written by the systemd service
+func serviceWritable(path string) bool {
+	path = filepath.Clean(path)
+	for _, writable := range serviceWritablePaths {
+		if strings.HasPrefix(path, writable+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCredentials loads the APNs credentials like the daemon
+func checkCredentials(cfg *config.Config) []finding {
+	var findings []finding
+	for i, info := range internal.CertificateInfos(cfg) {
+		// the first credentials are the ones of mail
+		check := "credentials"
+		if i > 0 {
+			check = strings.TrimPrefix(info.Subtopic, "com.apple.")
+		}
+		switch {
+		case info.Error != "":
+			findings = append(findings, finding{findingFail, check, info.Error,
+				"check the file names below /etc/xapsd and that they are readable by the " + serviceUser + " user"})
+		case info.TokenBased():
+			findings = append(findings, finding{status: findingOk, check: check, message: fmt.Sprintf("token key %s with topic %s", info.KeyId, info.Topic)})
+		case info.DaysLeft < 0:
+			findings = append(findings, finding{findingFail, check, fmt.Sprintf("certificate of %s expired at %s", info.Topic, info.NotAfter),
+				"renew the certificate"})
+		case info.DaysLeft < int(cfg.HealthCertExpiryDays):
+			findings = append(findings, finding{findingWarn, check, fmt.Sprintf("certificate of %s expires in %d days", info.Topic, info.DaysLeft),
+				"renew the certificate"})
+		case len(info.Environments) > 0 && !slices.Contains(info.Environments, "production"):
+			findings = append(findings, finding{findingWarn, check, fmt.Sprintf("certificate of %s is only valid for %s", info.Topic, strings.Join(info.Environments, ", ")),
+				"xapsd pushes to the production environment of APNs, use a production certificate"})
+		default:
+			findings = append(findings, finding{status: findingOk, check: check, message: fmt.Sprintf("certificate of %s valid for %d days", info.Topic, info.DaysLeft)})
+		}
+	}
+	return findings
+}
+
+// checkListeners binds all configured addresses. An address in use is
+// only a warning, as it may be the running daemon.
+func checkListeners(cfg *config.Config) []finding {
+	listeners := []struct{ name, addr, port string }{
+		{"port", cfg.ListenAddr, cfg.Port},
+		{"tlsPort", cfg.TlsListenAddr, cfg.TlsPort},
+		{"adminPort", cfg.AdminListenAddr, cfg.AdminPort},
+	}
+	var findings []finding
+	for _, listener := range listeners {
+		if listener.port == "" {
+			continue
+		}
+		address := listener.addr + ":" + listener.port
+		l, err := net.Listen("tcp", address)
+		switch {
+		case err == nil:
+			l.Close()
+			findings = append(findings, finding{status: findingOk, check: listener.name, message: address + " is bindable"})
+		case errors.Is(err, syscall.EADDRINUSE):
+			findings = append(findings, finding{findingWarn, listener.name, address + " is in use",
+				"this is expected while xapsd is running, otherwise choose another port"})
+		default:
+			findings = append(findings, finding{findingFail, listener.name, err.Error(),
+				"check the address and use a port above 1023 unless xapsd may bind privileged ports"})
+		}
+	}
+	return findings
+}
+
+// checkApnsReachable resolves and connects to the production gateway of APNs
+func checkApnsReachable() finding {
+	const check = "apns"
+	host := strings.TrimPrefix(apns2.HostProduction, "https://")
+	ctx, cancel := context.WithTimeout(context.Background(), apnsDialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return finding{findingFail, check, err.Error(), "check the DNS resolver, use -offline to skip this check"}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "443"), apnsDialTimeout)
+	if err != nil {
+		return finding{findingFail, check, err.Error(), "allow outgoing connections to " + host + ":443, use -offline to skip this check"}
+	}
+	conn.Close()
+	return finding{status: findingOk, check: check, message: fmt.Sprintf("%s resolves to %d addresses and is reachable", host, len(addrs))}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runHashPassword reads a password from stdin and prints the hash to be
+// used as adminPasswordHash. The prompt is only shown on a terminal, so
+// the hash can be captured by scripts, e.g. echo secret | xapsd hash-password
+func runHashPassword(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: xapsd hash-password < password")
+		return exitUsage
+	}
+	interactive := false
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+		fmt.Fprint(os.Stderr, "Please enter the password -> ")
+	}
+	reader := bufio.NewReader(os.Stdin)
+	text, err := reader.ReadString('\n')
+	if err != nil && text == "" {
+		fmt.Fprintln(os.Stderr, "Cannot read the password:", err)
+		return exitFailure
+	}
+	// remove newlines
+	text = strings.Replace(text, "\n", "", -1)
+	hash := sha256.Sum256([]byte(text))
+	fmt.Println(hex.EncodeToString(hash[:]))
+	if interactive {
+		fmt.Fprintln(os.Stderr, "For security reasons, we don't fill in the hash automagically. Please do so yourself.")
+	}
+	return exitOk
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+const pushUsage = `usage: xapsd [flags] push test user <username>|device <token>
+
+xapsd keeps the database in memory and overwrites the file, registrations
+reported as gone are not deleted. Use the admin API to delete them.`
+
+// runPush executes the push subcommands:
+//
+//	push test user <username>   send a test notification to all devices of a user
+//	push test device <token>    send a test notification to a device token
+//
+// It fails unless all notifications have been accepted by the push service.
+// Registrations reported as gone are kept, as a running daemon would
+// overwrite the changes to the database file.
+func runPush(args []string) int {
+	if len(args) != 3 || args[0] != "test" || (args[1] != "user" && args[1] != "device") {
+		fmt.Fprintln(os.Stderr, pushUsage)
+		return exitUsage
+	}
+	cfg, ok := loadConfig()
+	if !ok {
+		return exitFailure
+	}
+	db, err := database.NewDatabase(cfg.DatabaseFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot open database:", err)
+		return exitFailure
+	}
+
+	var registrations []database.Registration
+	if args[1] == "user" {
+		name, ok := canonicalUsername(&cfg, args[2])
+		if !ok {
+			return exitFailure
+		}
+		user, _ := db.GetUser(name)
+		for accountId, account := range user.Accounts {
+			registrations = append(registrations, account.Registration(name, accountId))
+		}
+	} else {
+		registrations = db.FindRegistrationsByDeviceToken(args[2])
+	}
+	if len(registrations) == 0 {
+		fmt.Fprintln(os.Stderr, "No registrations of", args[1], args[2])
+		return exitFailure
+	}
+
+	fmt.Fprintln(os.Stderr, "Registrations reported as gone are not deleted, use the admin API of a running daemon to delete them")
+	if _, err := os.Stat(cfg.WebPushVapidKeyFile); cfg.WebPushVapidKeyFile != "" && os.IsNotExist(err) {
+		// the key is generated by the daemon
+		fmt.Fprintln(os.Stderr, "VAPID key", cfg.WebPushVapidKeyFile, "doesn't exist, skipping Web Push subscriptions")
+		cfg.WebPushVapidKeyFile = ""
+	}
+	_, dispatcher := newDispatcher(&cfg, db)
+	dispatcher.KeepGone()
+	results := dispatcher.SendTestNotifications(log.NewEntry(log.StandardLogger()), registrations)
+	code := printJson(results)
+	for _, result := range results {
+		if result.Error != "" || result.StatusCode < http.StatusOK || result.StatusCode >= http.StatusMultipleChoices {
+			code = exitFailure
+		}
+	}
+	return code
+}
@@ -26,37 +26,121 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha256"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/freswa/dovecot-xaps-daemon/internal"
 	"github.com/freswa/dovecot-xaps-daemon/internal/config"
 	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
 	log "github.com/sirupsen/logrus"
 	"os"
-	"strings"
+	"os/signal"
+	"sort"
+	"syscall"
 )
 
 const Version = "1.1"
 
+// exit codes of all commands
+const (
+	exitOk      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
 var configPath = flag.String("configPath", "", `Add an additional path to lookup the config file in`)
 var configName = flag.String("configName", "", `Set a different configName (without extension) than the default "xapsd"`)
-var generatePassword = flag.Bool("pass", false, `Generate a password hash to be used in the xapsd.yaml`)
+var generatePassword = flag.Bool("pass", false, `Generate a password hash to be used in the xapsd.yaml (deprecated, use hash-password)`)
+
+// command is a subcommand of xapsd, run returns the exit code
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands = map[string]command{
+	"serve":         {"serve                          run the daemon (default)", runServe},
+	"version":       {"version                        print the version", runVersion},
+	"hash-password": {"hash-password                  hash a password read from stdin for adminPasswordHash", runHashPassword},
+	"cert":          {"cert info                      show the APNs certificates", runCert},
+	"db":            {"db <command>                   inspect and edit the database, see xapsd db", runDb},
+	"push":          {"push test user|device          send a test notification", runPush},
+	"config":        {"config check|dump              validate or print the configuration", runConfig},
+	"doctor":        {"doctor [-offline]              check the setup and print findings", runDoctor},
+}
 
 func main() {
+	config.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
 	if *generatePassword {
-		hashPassword()
+		os.Exit(runHashPassword(nil))
+	}
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.run(args))
+}
+
+// usage prints the commands, the global flags precede the command
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: xapsd [flags] [command]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nexit codes: 0 success, 1 failure, 2 invalid usage")
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+// loadConfig parses and validates the configuration, errors are printed
+func loadConfig() (config.Config, bool) {
 	config.ParseConfig(*configName, *configPath)
 	cfg := config.GetOptions()
+	if err := cfg.Validate(); err != nil {
+		printConfigErrors(err)
+		return cfg, false
+	}
 	lvl, err := log.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.SetLevel(lvl)
+	return cfg, true
+}
+
+func runVersion(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: xapsd version")
+		return exitUsage
+	}
+	fmt.Println("xapsd", Version)
+	return exitOk
+}
+
+// runServe runs the daemon until it fails
+func runServe(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: xapsd [flags] serve")
+		return exitUsage
+	}
+	cfg, ok := loadConfig()
+	if !ok {
+		return exitFailure
+	}
 
 	log.Debugln("Opening databasefile at", cfg.DatabaseFile)
 	db, err := database.NewDatabase(cfg.DatabaseFile)
@@ -64,21 +148,58 @@ func main() {
 		log.Fatal("Cannot open databasefile: ", err)
 	}
 
-	apns := internal.NewApns(&cfg, db)
-	internal.NewHttpSocket(&cfg, db, apns)
+	usernames, err := username.NewCanonicalizer(&cfg)
+	if err != nil {
+		log.Fatal("Cannot setup username canonicalization: ", err)
+	}
+
+	apns, dispatcher := newDispatcher(&cfg, db)
+	reloader := internal.NewReloader(&cfg, config.Reload, dispatcher, apns)
+	reloadOnHangup(reloader)
+	if cfg.WatchConfig {
+		config.WatchConfig(func() { reloader.Reload() })
+	}
+	internal.NewAdminSocket(&cfg, db, dispatcher, usernames, reloader)
+	internal.NewHttpSocket(&cfg, db, apns, dispatcher, usernames, reloader)
+	return exitOk
+}
+
+// newDispatcher registers the notifiers of all configured backends
+func newDispatcher(cfg *config.Config, db *database.Database) (*internal.Apns, *internal.Dispatcher) {
+	apns := internal.NewApns(cfg)
+	dispatcher := internal.NewDispatcher(cfg, db)
+	dispatcher.Register(apns)
+	subtopicApns, err := internal.NewSubtopicApns(cfg)
+	if err != nil {
+		log.Fatalln("Could not setup calendar and contacts push:", err)
+	}
+	for _, notifier := range subtopicApns {
+		dispatcher.Register(notifier)
+	}
+	if cfg.WebPushVapidKeyFile != "" {
+		webPush, err := internal.NewWebPush(cfg, db)
+		if err != nil {
+			log.Fatalln("Could not setup web push:", err)
+		}
+		dispatcher.Register(webPush)
+		db.KeepUntilGone(webPush.Backend())
+	}
+	if cfg.UnifiedPushEnabled {
+		unifiedPush := internal.NewUnifiedPush(cfg)
+		dispatcher.Register(unifiedPush)
+		db.KeepUntilGone(unifiedPush.Backend())
+	}
+	return apns, dispatcher
 }
 
-// function to generate the password
-func hashPassword() {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Please enter the password -> ")
-	text, _ := reader.ReadString('\n')
-	// remove newlines
-	text = strings.Replace(text, "\n", "", -1)
-	hash := sha256.New()
-	hash.Write([]byte(text))
-	sha256sum := hex.EncodeToString(hash.Sum(nil))
-	fmt.Printf("This is the hash -> %s\n", sha256sum)
-	fmt.Print("For security reasons, we don't fill in the hash automagically. Please do so yourself.\n")
-	os.Exit(0)
+// reloadOnHangup reloads the configuration in the background whenever
+// SIGHUP is received
+func reloadOnHangup(reloader *internal.Reloader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reloader.Reload()
+		}
+	}()
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCommands_Usage checks that invalid arguments are rejected before the
+// configuration is loaded
+func TestCommands_Usage(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		args    []string
+	}{
+		{"serve", []string{"now"}},
+		{"version", []string{"-v"}},
+		{"hash-password", []string{"secret"}},
+		{"cert", nil},
+		{"cert", []string{"list"}},
+		{"cert", []string{"info", "-days", "soon"}},
+		{"cert", []string{"info", "-unknown"}},
+		{"cert", []string{"info", "extra"}},
+		{"db", nil},
+		{"db", []string{"show"}},
+		{"db", []string{"delete", "stefan", "account", "extra"}},
+		{"db", []string{"cleanup", "now"}},
+		{"db", []string{"drop"}},
+		{"push", []string{"test", "user"}},
+		{"push", []string{"test", "group", "admins"}},
+		{"push", []string{"send", "user", "stefan"}},
+		{"config", nil},
+		{"config", []string{"edit"}},
+		{"doctor", []string{"-unknown"}},
+		{"doctor", []string{"extra"}},
+	} {
+		cmd, ok := commands[test.command]
+		if !ok {
+			t.Fatal("Unknown command", test.command)
+		}
+		if code := cmd.run(test.args); code != exitUsage {
+			t.Errorf("xapsd %s %s: expected exit code %d, got %d", test.command, strings.Join(test.args, " "), exitUsage, code)
+		}
+	}
+}
+
+func TestCommands_UsageText(t *testing.T) {
+	for name, cmd := range commands {
+		if !strings.HasPrefix(cmd.usage, name+" ") {
+			t.Errorf("Usage of %s doesn't start with its name: %q", name, cmd.usage)
+		}
+	}
+}
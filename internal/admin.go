@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+type adminHandler struct {
+	db           *database.Database
+	dispatcher   *Dispatcher
+	usernames    *username.Canonicalizer
+	reloader     *Reloader
+	user         string
+	passwordHash string
+}
+
+// TestResult is the outcome of a test notification sent via the admin API
+type TestResult struct {
+	AccountId   string
+	DeviceToken string
+	Backend     string
+	StatusCode  int    `json:",omitempty"`
+	Reason      string `json:",omitempty"`
+	// ApnsId is the id assigned to the notification by the push service
+	ApnsId string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// NewAdminSocket starts the admin API in the background if an admin port is configured.
+//
+//	GET    /users?search=foo                      list users matching username, account id or device token
+//	GET    /users/:username                       show a single user
+//	DELETE /users/:username                       delete all registrations of a user
+//	DELETE /users/:username/accounts/:accountid   delete a registration
+//	DELETE /devices/:token                        delete all registrations of a device token
+//	POST   /users/:username/test                  send a test notification to all devices of a user
+//	POST   /devices/:token/test                   send a test notification to a device token
+//	POST   /cleanup                               delete registrations not renewed within 30 days
+//	GET    /reload                                show the outcome of the last reload of the configuration
+//	POST   /reload                                reload the configuration like SIGHUP
+func NewAdminSocket(config *config.Config, db *database.Database, dispatcher *Dispatcher, usernames *username.Canonicalizer, reloader *Reloader) {
+	if config.AdminPort == "" {
+		return
+	}
+	router := newAdminRouter(config, db, dispatcher, usernames, reloader)
+	limits := newHttpLimits(config)
+	server := newHttpServer(limits, config.AdminListenAddr+":"+config.AdminPort, withRequestId(router))
+	go func() {
+		err := listenAndServe(server, limits)
+		if err != nil {
+			log.Fatalf("Could not listen on address %s:%s: %s", config.AdminListenAddr, config.AdminPort, err)
+		}
+	}()
+}
+
+// newAdminRouter registers the routes of the admin API, all of them require
+// basic auth
+func newAdminRouter(config *config.Config, db *database.Database, dispatcher *Dispatcher, usernames *username.Canonicalizer, reloader *Reloader) *httprouter.Router {
+	router := httprouter.New()
+	admin := adminHandler{db, dispatcher, usernames, reloader, config.AdminUser, strings.ToLower(config.AdminPasswordHash)}
+	router.GET("/users", admin.authenticated(admin.handleListUsers))
+	router.GET("/users/:username", admin.authenticated(admin.handleGetUser))
+	httpSocket := httpHandler{db: db, dispatcher: dispatcher, usernames: usernames}
+	httpSocket.registerUnregisterRoutes(router, "", admin.authenticated)
+	router.POST("/users/:username/test", admin.authenticated(admin.handleTestUser))
+	router.POST("/devices/:token/test", admin.authenticated(admin.handleTestDevice))
+	router.POST("/cleanup", admin.authenticated(admin.handleCleanup))
+	router.GET("/reload", admin.authenticated(admin.handleReloadStatus))
+	router.POST("/reload", admin.authenticated(admin.handleReload))
+	return router
+}
+
+// authenticated wraps the handle with HTTP basic auth, config.Validate
+// ensures the password hash is set
+func (admin *adminHandler) authenticated(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		user, password, ok := request.BasicAuth()
+		hash := sha256.Sum256([]byte(password))
+		hashHex := hex.EncodeToString(hash[:])
+		if !ok || user != admin.user || subtle.ConstantTimeCompare([]byte(hashHex), []byte(admin.passwordHash)) != 1 {
+			log.Warnf("Unauthorized admin request from %s", request.RemoteAddr)
+			writer.Header().Set("WWW-Authenticate", `Basic realm="xapsd"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handle(writer, request, params)
+	}
+}
+
+func (admin *adminHandler) handleListUsers(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	writeJson(writer, http.StatusOK, admin.db.SearchUsers(request.URL.Query().Get("search")))
+}
+
+func (admin *adminHandler) handleGetUser(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	_, user, ok := admin.getUser(params.ByName("username"))
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJson(writer, http.StatusOK, user)
+}
+
+// getUser looks up the user by its canonical name, which is returned too
+func (admin *adminHandler) getUser(name string) (string, database.User, bool) {
+	canonical, err := admin.usernames.Canonicalize(name)
+	if err != nil {
+		return "", database.User{}, false
+	}
+	user, ok := admin.db.GetUser(canonical)
+	return canonical, user, ok
+}
+
+func (admin *adminHandler) handleCleanup(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	deleted := admin.db.Cleanup()
+	log.Infoln("Admin cleanup deleted", deleted, "registrations")
+	writeJson(writer, http.StatusOK, map[string]int{"Deleted": deleted})
+}
+
+func (admin *adminHandler) handleReloadStatus(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writeJson(writer, http.StatusOK, admin.reloader.Status())
+}
+
+// handleReload replies 422 if the configuration could not be reloaded
+func (admin *adminHandler) handleReload(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	status := admin.reloader.Reload()
+	if status.Status != reloadOk {
+		writeJson(writer, http.StatusUnprocessableEntity, status)
+		return
+	}
+	writeJson(writer, http.StatusOK, status)
+}
+
+func (admin *adminHandler) handleTestUser(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	username, user, ok := admin.getUser(params.ByName("username"))
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var registrations []database.Registration
+	for accountId, account := range user.Accounts {
+		registrations = append(registrations, account.Registration(username, accountId))
+	}
+	writeJson(writer, http.StatusOK, admin.dispatcher.SendTestNotifications(requestLogger(request), registrations))
+}
+
+func (admin *adminHandler) handleTestDevice(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	registrations := admin.db.FindRegistrationsByDeviceToken(params.ByName("token"))
+	if len(registrations) == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJson(writer, http.StatusOK, admin.dispatcher.SendTestNotifications(requestLogger(request), registrations))
+}
+
+// SendTestNotifications pushes a notification to each registration without delay
+func (dispatcher *Dispatcher) SendTestNotifications(logger *log.Entry, registrations []database.Registration) []TestResult {
+	results := make([]TestResult, 0, len(registrations))
+	for _, registration := range registrations {
+		logger.Infoln("Sending test notification to", registration.AccountId, "/", registration.DeviceToken)
+		outcome, err := dispatcher.Push(logger, registration)
+		result := TestResult{
+			AccountId:   registration.AccountId,
+			DeviceToken: registration.DeviceToken,
+			Backend:     registration.Backend,
+			StatusCode:  outcome.StatusCode,
+			Reason:      outcome.Reason,
+			ApnsId:      outcome.Id,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func writeJson(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(v)
+	if err != nil {
+		log.Errorln("Could not write response:", err)
+	}
+}
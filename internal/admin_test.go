@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sha256 of "secret"
+const testAdminPasswordHash = "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+
+func newAdminTestRouter(t *testing.T, dispatcher *Dispatcher) *httprouter.Router {
+	usernames, err := username.NewCanonicalizer(&config.Config{})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer", err)
+	}
+	// hex digits of the hash may be upper case
+	cfg := &config.Config{AdminUser: "admin", AdminPasswordHash: strings.ToUpper(testAdminPasswordHash)}
+	return newAdminRouter(cfg, dispatcher.db, dispatcher, usernames, nil)
+}
+
+// serveAdmin sends the request with basic auth unless user is empty
+func serveAdmin(router http.Handler, method, path, user, password string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	}
+	recorder := httptest.NewRecorder()
+	withRequestId(router).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAdmin_Authentication(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	if err := dispatcher.db.AddRegistration("stefan", "account1", "token1", []string{"INBOX"}); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	router := newAdminTestRouter(t, dispatcher)
+
+	for _, test := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"root", "secret", http.StatusUnauthorized},
+		{"admin", "secret", http.StatusOK},
+	} {
+		recorder := serveAdmin(router, http.MethodGet, "/users", test.user, test.password)
+		if recorder.Code != test.status {
+			t.Errorf("%q/%q: expected %d, got %d", test.user, test.password, test.status, recorder.Code)
+		}
+		if recorder.Code == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Error("Missing WWW-Authenticate header")
+		}
+		if recorder.Code != http.StatusOK && strings.Contains(recorder.Body.String(), "token1") {
+			t.Error("Registrations disclosed without authentication")
+		}
+	}
+
+	// every route is protected
+	for _, path := range []string{"/users/stefan/test", "/devices/token1/test", "/cleanup", "/reload"} {
+		if recorder := serveAdmin(router, http.MethodPost, path, "admin", "wrong"); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", path, recorder.Code)
+		}
+	}
+}
+
+func TestAdmin_TestNotifications(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	notifier := &testNotifier{backend: "test", errors: []error{nil, errors.New("BadDeviceToken")}}
+	dispatcher.Register(notifier)
+	db := dispatcher.db
+	if err := db.AddBackendRegistration("test", "stefan", "account1", "token1", []string{"INBOX"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	if err := db.AddBackendRegistration("unknown", "stefan", "account2", "token2", []string{"INBOX"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	if err := db.AddBackendRegistration("test", "alice", "account3", "token1", []string{"INBOX"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	router := newAdminTestRouter(t, dispatcher)
+
+	recorder := serveAdmin(router, http.MethodPost, "/users/Stefan/test", "admin", "secret")
+	var results []TestResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); recorder.Code != http.StatusOK || err != nil || len(results) != 2 {
+		t.Fatal("Unexpected response:", recorder.Code, recorder.Body)
+	}
+	for _, result := range results {
+		switch result.AccountId {
+		case "account1":
+			if result.Error != "" || result.Backend != "test" || result.DeviceToken != "token1" {
+				t.Error("Unexpected result", result)
+			}
+		case "account2":
+			if !strings.Contains(result.Error, "no notifier for backend unknown") {
+				t.Error("Expected an error of the unknown backend, got", result)
+			}
+		default:
+			t.Error("Unexpected account", result)
+		}
+	}
+	if len(notifier.pushed) != 1 || notifier.pushed[0].Username != "stefan" {
+		t.Error("Unexpected pushes", notifier.pushed)
+	}
+
+	// the device token is registered by both users
+	recorder = serveAdmin(router, http.MethodPost, "/devices/token1/test", "admin", "secret")
+	results = nil
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); recorder.Code != http.StatusOK || err != nil || len(results) != 2 {
+		t.Fatal("Unexpected response:", recorder.Code, recorder.Body)
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Error("Expected one failed notification, got", results)
+	}
+
+	for _, path := range []string{"/users/nobody/test", "/devices/unknown/test"} {
+		if recorder := serveAdmin(router, http.MethodPost, path, "admin", "secret"); recorder.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, recorder.Code)
+		}
+	}
+}
+
+func TestAdmin_RequiresPassword(t *testing.T) {
+	cfg := &config.Config{AdminPort: "11621", AdminUser: "admin"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "adminPasswordHash: required by adminPort") {
+		t.Error("Admin API without password accepted:", err)
+	}
+	cfg.AdminPasswordHash = testAdminPasswordHash
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "adminPasswordHash") {
+		t.Error("Valid password hash rejected:", err)
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiPrefix is the prefix of the versioned API. Its routes reply with JSON
+// bodies, the unversioned routes keep the bare responses expected by the
+// dovecot plugin.
+const apiPrefix = "/v1"
+
+// error codes of the versioned API
+const (
+	errorInvalidRequest      = "invalid_request"
+	errorInvalidRegistration = "invalid_registration"
+	errorInvalidNotification = "invalid_notification"
+	errorInvalidUsername     = "invalid_username"
+	errorPayloadTooLarge     = "payload_too_large"
+	errorRateLimited         = "rate_limited"
+	errorUnknownUser         = "unknown_user"
+	errorNotFound            = "not_found"
+	errorMethodNotAllowed    = "method_not_allowed"
+	errorInternal            = "internal_error"
+)
+
+//go:embed openapi.json
+var openApi []byte
+
+// ErrorResponse is the body of every failed request to the versioned API
+type ErrorResponse struct {
+	Code       string
+	Message    string
+	RequestId  string
+	Violations []Violation `json:",omitempty"`
+}
+
+// RegisterResponse is the body of a successful registration
+type RegisterResponse struct {
+	Topic string
+}
+
+type apiVersionKey struct{}
+
+// versioned marks requests to be answered by the versioned API
+func versioned(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		ctx := context.WithValue(request.Context(), apiVersionKey{}, apiPrefix)
+		handle(writer, request.WithContext(ctx), params)
+	}
+}
+
+func unversioned(handle httprouter.Handle) httprouter.Handle {
+	return handle
+}
+
+// isVersioned returns whether the request is handled by the versioned API
+func isVersioned(request *http.Request) bool {
+	return request.Context().Value(apiVersionKey{}) != nil
+}
+
+// writeError replies with an ErrorResponse or only the status for unversioned requests
+func writeError(writer http.ResponseWriter, request *http.Request, status int, code, message string) {
+	if !isVersioned(request) {
+		writer.WriteHeader(status)
+		return
+	}
+	writeJson(writer, status, ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestId: requestId(requestLogger(request)),
+	})
+}
+
+// writeDecodeError replies to a request with a body that could not be read
+func writeDecodeError(writer http.ResponseWriter, request *http.Request, err error) {
+	status := decodeStatus(err)
+	if status == http.StatusRequestEntityTooLarge {
+		writeError(writer, request, status, errorPayloadTooLarge, err.Error())
+		return
+	}
+	writeError(writer, request, status, errorInvalidRequest, err.Error())
+}
+
+// writeViolations replies 400 listing all violations of a registration
+func writeViolations(writer http.ResponseWriter, request *http.Request, violations []Violation) {
+	writeCodeViolations(writer, request, errorInvalidRegistration, "invalid registration", violations)
+}
+
+// writeCodeViolations replies 400 listing all violations with the error code
+func writeCodeViolations(writer http.ResponseWriter, request *http.Request, code, message string, violations []Violation) {
+	if !isVersioned(request) {
+		writeJson(writer, http.StatusBadRequest, ValidationErrors{Violations: violations})
+		return
+	}
+	writeJson(writer, http.StatusBadRequest, ErrorResponse{
+		Code:       code,
+		Message:    message,
+		RequestId:  requestId(requestLogger(request)),
+		Violations: violations,
+	})
+}
+
+func handleOpenApi(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(openApi)
+}
+
+// apiFallback replies with an ErrorResponse to unknown routes of the versioned API
+func apiFallback(status int, code string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !strings.HasPrefix(request.URL.Path, apiPrefix+"/") {
+			http.Error(writer, http.StatusText(status), status)
+			return
+		}
+		versioned(func(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+			writeError(writer, request, status, code, http.StatusText(status))
+		})(writer, request, nil)
+	})
+}
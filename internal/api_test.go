@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+	"github.com/julienschmidt/httprouter"
+)
+
+func newApiTestRouter(t *testing.T) *httprouter.Router {
+	router, _ := newApiTestHandler(t)
+	return router
+}
+
+// newApiTestHandler returns the router of the API and its handler, the
+// dispatcher has no notifiers
+func newApiTestHandler(t *testing.T) (*httprouter.Router, *httpHandler) {
+	dispatcher := newTestDispatcher(t)
+	policy, err := newNotificationPolicy(config.NotificationPolicy{}, time.Second)
+	if err != nil {
+		t.Fatal("Cannot create policy", err)
+	}
+	usernames, err := username.NewCanonicalizer(&config.Config{})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer", err)
+	}
+	handler := &httpHandler{db: dispatcher.db, apns: &Apns{Topic: "com.apple.mail.test"}, dispatcher: dispatcher, maxBodyBytes: 4096, policy: policy, usernames: usernames}
+
+	router := httprouter.New()
+	handler.registerRoutes(router, "", unversioned)
+	handler.registerRoutes(router, apiPrefix, versioned)
+	newHealthHandler(&config.Config{}, handler.db, handler.apns, nil).registerRoutes(router, apiPrefix, versioned)
+	router.GET(apiPrefix+"/openapi.json", handleOpenApi)
+	router.NotFound = apiFallback(http.StatusNotFound, errorNotFound)
+	return router, handler
+}
+
+func serve(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	withRequestId(router).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestApi_Register(t *testing.T) {
+	router := newApiTestRouter(t)
+	reg, _ := json.Marshal(validRegister())
+
+	recorder := serve(router, http.MethodPost, "/register", string(reg))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "com.apple.mail.test" {
+		t.Errorf("Unversioned register replied %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve(router, http.MethodPost, "/v1/register", string(reg))
+	var response RegisterResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Topic != "com.apple.mail.test" {
+		t.Errorf("Versioned register replied %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve(router, http.MethodPost, "/v1/register", `{"ApsAccountId":"A\"A"}`)
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &errorResponse); err != nil {
+		t.Fatal("Cannot decode error response:", err)
+	}
+	if recorder.Code != http.StatusBadRequest || errorResponse.Code != errorInvalidRegistration || len(errorResponse.Violations) != 5 {
+		t.Errorf("Unexpected error response %d %+v", recorder.Code, errorResponse)
+	}
+	if errorResponse.RequestId == "" || errorResponse.RequestId != recorder.Header().Get(requestIdHeader) {
+		t.Errorf("Request id %q does not match the header %q", errorResponse.RequestId, recorder.Header().Get(requestIdHeader))
+	}
+}
+
+func TestApi_Errors(t *testing.T) {
+	router := newApiTestRouter(t)
+	notify := `{"Username":"nobody","Mailbox":"INBOX","Events":["MessageNew"]}`
+
+	recorder := serve(router, http.MethodPost, "/notify", notify)
+	if recorder.Code != http.StatusNotFound || recorder.Body.Len() != 0 {
+		t.Errorf("Unversioned notify replied %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	for _, test := range []struct {
+		method, path, body, code string
+		status                   int
+	}{
+		{http.MethodPost, "/v1/notify", notify, errorUnknownUser, http.StatusNotFound},
+		{http.MethodPost, "/v1/notify", `{"Username":"nobody"}`, errorInvalidNotification, http.StatusBadRequest},
+		{http.MethodPost, "/v1/notify/batch", `[]`, errorInvalidRequest, http.StatusBadRequest},
+		{http.MethodPost, "/v1/ox", `{`, errorInvalidRequest, http.StatusBadRequest},
+		{http.MethodPost, "/v1/notify", strings.Repeat(" ", 5000), errorPayloadTooLarge, http.StatusRequestEntityTooLarge},
+		{http.MethodDelete, "/v1/devices/abc", ``, errorNotFound, http.StatusNotFound},
+		{http.MethodGet, "/v1/unknown", ``, errorNotFound, http.StatusNotFound},
+	} {
+		recorder := serve(router, test.method, test.path, test.body)
+		var response ErrorResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Errorf("%s %s: cannot decode %q: %s", test.method, test.path, recorder.Body.String(), err)
+			continue
+		}
+		if recorder.Code != test.status || response.Code != test.code {
+			t.Errorf("%s %s: expected %d %s, got %d %s", test.method, test.path, test.status, test.code, recorder.Code, response.Code)
+		}
+	}
+}
+
+func TestApi_OpenApi(t *testing.T) {
+	router := newApiTestRouter(t)
+
+	var document struct {
+		Paths map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal(openApi, &document); err != nil {
+		t.Fatal("Cannot parse OpenAPI description:", err)
+	}
+	if len(document.Paths) == 0 {
+		t.Fatal("No paths documented")
+	}
+	for path, operations := range document.Paths {
+		// replace the {parameters} of the path
+		var segments []string
+		for _, segment := range strings.Split(path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				segment = "x"
+			}
+			segments = append(segments, segment)
+		}
+		for method := range operations {
+			if handle, _, _ := router.Lookup(strings.ToUpper(method), apiPrefix+strings.Join(segments, "/")); handle == nil {
+				t.Errorf("Documented route %s %s is not served", method, path)
+			}
+		}
+	}
+}
+
+func TestApi_NotifyBatch(t *testing.T) {
+	router, handler := newApiTestHandler(t)
+	notifier := &testNotifier{backend: database.DefaultBackend}
+	handler.dispatcher.Register(notifier)
+	for _, reg := range []struct{ username, accountId, token, mailbox string }{
+		{"stefan", "account1", "token1", "INBOX"},
+		{"alice", "account2", "token2", "INBOX"},
+		{"bob", "account3", "token3", "Archive"},
+	} {
+		if err := handler.db.AddRegistration(reg.username, reg.accountId, reg.token, []string{reg.mailbox}); err != nil {
+			t.Fatal("Cannot add registration", err)
+		}
+	}
+
+	batch := `[
+		{"Username":"stefan","Mailbox":"INBOX","Events":["FlagsSet"]},
+		{"Username":"stefan","Mailbox":"INBOX","Events":["MessageNew"]},
+		{"Username":"nobody","Mailbox":"INBOX","Events":["MessageNew"]},
+		{"Username":"stefan"},
+		{"Username":"alice","Mailbox":"Junk","Events":["MessageNew"]},
+		{"Username":"bob","Mailbox":"INBOX","Events":["MessageNew"]}
+	]`
+	recorder := serve(router, http.MethodPost, "/v1/notify/batch", batch)
+	var results []NotifyResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); recorder.Code != http.StatusOK || err != nil {
+		t.Fatal("Unexpected response:", recorder.Code, recorder.Body)
+	}
+	for i, expected := range []NotifyResult{
+		{Username: "stefan", Mailbox: "INBOX", Status: http.StatusOK, Registrations: 1},
+		{Username: "stefan", Mailbox: "INBOX", Status: http.StatusOK, Registrations: 1},
+		{Username: "nobody", Mailbox: "INBOX", Status: http.StatusNotFound},
+		{Username: "stefan", Status: http.StatusBadRequest},
+		// other mailboxes than INBOX are ignored by default
+		{Username: "alice", Mailbox: "Junk", Status: http.StatusOK},
+		{Username: "bob", Mailbox: "INBOX", Status: http.StatusNoContent},
+	} {
+		if i >= len(results) || results[i] != expected {
+			t.Errorf("Item %d: expected %+v, got %+v", i, expected, results)
+		}
+	}
+
+	// the delayed and the immediate item are merged into one immediate push
+	if len(notifier.pushed) != 1 || notifier.pushed[0].AccountId != "account1" {
+		t.Error("Expected a single push to account1, got", notifier.pushed)
+	}
+	if size := handler.dispatcher.QueueSize(); size != 0 {
+		t.Error("Delayed notification queued along the immediate one:", size)
+	}
+
+	// delayed items of the same user are queued once
+	notifier.pushed = nil
+	recorder = serve(router, http.MethodPost, "/v1/notify/batch", `[
+		{"Username":"stefan","Mailbox":"INBOX","Events":["FlagsSet"]},
+		{"Username":"stefan","Mailbox":"INBOX","Events":["MessageRead"]}
+	]`)
+	if recorder.Code != http.StatusOK || len(notifier.pushed) != 0 || handler.dispatcher.QueueSize() != 1 {
+		t.Error("Expected one queued notification, got", recorder.Code, notifier.pushed, handler.dispatcher.QueueSize())
+	}
+}
+
+func TestApi_NotifyBatchTooLarge(t *testing.T) {
+	router := newApiTestRouter(t)
+
+	item := `{"Username":"stefan","Mailbox":"INBOX","Events":["MessageNew"]}`
+	batch := "[" + strings.Repeat(item+",", 4096/len(item)) + item + "]"
+	recorder := serve(router, http.MethodPost, "/v1/notify/batch", batch)
+	var response ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusRequestEntityTooLarge || response.Code != errorPayloadTooLarge {
+		t.Errorf("Expected 413 %s, got %d %q", errorPayloadTooLarge, recorder.Code, recorder.Body.String())
+	}
+}
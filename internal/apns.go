@@ -3,7 +3,9 @@ package internal
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/freswa/dovecot-xaps-daemon/internal/config"
 	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/token"
@@ -25,76 +28,82 @@ const (
 var (
 	oidUid        = []int{0, 9, 2342, 19200300, 100, 1, 1}
 	productionOID = []int{1, 2, 840, 113635, 100, 6, 3, 2}
+	sandboxOID    = []int{1, 2, 840, 113635, 100, 6, 3, 1}
 	//GeoTrustCert  = "-----BEGIN CERTIFICATE-----\nMIIDVDCCAjygAwIBAgIDAjRWMA0GCSqGSIb3DQEBBQUAMEIxCzAJBgNVBAYTAlVT\nMRYwFAYDVQQKEw1HZW9UcnVzdCBJbmMuMRswGQYDVQQDExJHZW9UcnVzdCBHbG9i\nYWwgQ0EwHhcNMDIwNTIxMDQwMDAwWhcNMjIwNTIxMDQwMDAwWjBCMQswCQYDVQQG\nEwJVUzEWMBQGA1UEChMNR2VvVHJ1c3QgSW5jLjEbMBkGA1UEAxMSR2VvVHJ1c3Qg\nR2xvYmFsIENBMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA2swYYzD9\n9BcjGlZ+W988bDjkcbd4kdS8odhM+KhDtgPpTSEHCIjaWC9mOSm9BXiLnTjoBbdq\nfnGk5sRgprDvgOSJKA+eJdbtg/OtppHHmMlCGDUUna2YRpIuT8rxh0PBFpVXLVDv\niS2Aelet8u5fa9IAjbkU+BQVNdnARqN7csiRv8lVK83Qlz6cJmTM386DGXHKTubU\n1XupGc1V3sjs0l44U+VcT4wt/lAjNvxm5suOpDkZALeVAjmRCw7+OC7RHQWa9k0+\nbw8HHa8sHo9gOeL6NlMTOdReJivbPagUvTLrGAMoUgRx5aszPeE4uwc2hGKceeoW\nMPRfwCvocWvk+QIDAQABo1MwUTAPBgNVHRMBAf8EBTADAQH/MB0GA1UdDgQWBBTA\nephojYn7qwVkDBF9qn1luMrMTjAfBgNVHSMEGDAWgBTAephojYn7qwVkDBF9qn1l\nuMrMTjANBgkqhkiG9w0BAQUFAAOCAQEANeMpauUvXVSOKVCUn5kaFOSPeCpilKIn\nZ57QzxpeR+nBsqTP3UEaBU6bS+5Kb1VSsyShNwrrZHYqLizz/Tt1kL/6cdjHPTfS\ntQWVYrmm3ok9Nns4d0iXrKYgjy6myQzCsplFAMfOEVEiIuCl6rYVSAlk6l5PdPcF\nPseKUgzbFbS9bZvlxrFUaKnjaZC2mqUPuLk/IH2uSrW4nOQdtqvmlKXBx4Ot2/Un\nhw4EbNX/3aBd7YdStysVAq45pmp06drE57xNNB6pXE0zX5IJL4hmXXeXxx12E6nV\n5fEWCRE11azbJHFwLJhWC9kXtNHjUStedejV0NxPNO3CBWaAocvmMw==\n-----END CERTIFICATE-----"
 )
 
+// backends of the registrations notified via APNs
+const (
+	backendApns         = database.DefaultBackend
+	backendApnsCalendar = "apns-calendar"
+	backendApnsContacts = "apns-contacts"
+)
+
+// subtopicBackends maps the subtopics of registrations to their backend
+var subtopicBackends = map[string]string{
+	subtopicMail:     backendApns,
+	subtopicCalendar: backendApnsCalendar,
+	subtopicContacts: backendApnsContacts,
+}
+
+// Apns is the Notifier sending notifications via the Apple Push Notification
+// service. Each subtopic uses its own certificate and topic.
 type Apns struct {
-	DelayTime            uint
-	Topic                string
-	CheckDelayedInterval uint
-	client               *apns2.Client
-	db                   *database.Database
-	mapMutex             sync.Mutex
-	delayedApns          map[database.Registration]time.Time
-	RenewTimer           *time.Timer
-}
-
-func NewApns(cfg *config.Config, db *database.Database) (apns *Apns) {
-	apns = &Apns{
-		DelayTime:            cfg.Delay,
-		CheckDelayedInterval: cfg.CheckInterval,
-		db:                   db,
-		mapMutex:             sync.Mutex{},
-		delayedApns:          make(map[database.Registration]time.Time),
-	}
-	log.Debugln("APNS for non NewMessage events will be delayed for", time.Second*time.Duration(apns.DelayTime))
-
-	if cfg.CertificateFileP12 != "" {
-		log.Debugf("Loading Certificate at %s", "/etc/xapsd/"+cfg.CertificateFileP12)
-		cert, err := certificate.FromP12File("/etc/xapsd/"+cfg.CertificateFileP12, "")
-		if err != nil {
-			log.Fatal("Cert Error:", err)
-		}
-		topic, err := topicFromCertificate(cert)
-		if err != nil {
-			log.Fatalln("Could not parse apns topic from certificate: ", err)
-		}
-		apns.Topic = topic
-		apns.client = apns2.NewClient(cert).Production()
-	} else if cfg.CertificateFilePem != "" {
-		log.Debugf("Loading Certificate at %s", "/etc/xapsd/"+cfg.CertificateFilePem)
-		certData, err := ioutil.ReadFile("/etc/xapsd/" + cfg.CertificateFilePem)
-		if err != nil {
-			log.Fatal("Cert Error:", err)
-		}
-		keyData, err := ioutil.ReadFile("/etc/xapsd/" + cfg.CertificateFilePemKey)
-		if err != nil {
-			log.Fatal("Key Error:", err)
-		}
-		cert, err := tls.X509KeyPair(certData, keyData)
+	// mutex guards the credentials replaced by update
+	mutex      sync.RWMutex
+	Topic      string
+	subtopic   string
+	client     *apns2.Client
+	RenewTimer *time.Timer
+	// zero for token based authentication
+	CertificateExpiry time.Time
+	pushRecorder
+}
+
+func NewApns(cfg *config.Config) *Apns {
+	apns, err := newApns(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	apns.recordCertificateExpiry()
+	return apns
+}
+
+// newApns creates the notifier of the mail subtopic from the certificate
+// or the token key of cfg
+func newApns(cfg *config.Config) (*Apns, error) {
+	apns := &Apns{subtopic: subtopicMail}
+
+	if cfg.CertificateFileP12 != "" || cfg.CertificateFilePem != "" {
+		cert, err := loadCertificate(config.ApnsCertificate{
+			CertificateFileP12:    cfg.CertificateFileP12,
+			CertificateFilePem:    cfg.CertificateFilePem,
+			CertificateFilePemKey: cfg.CertificateFilePemKey,
+		})
 		if err != nil {
-			log.Fatal("Cert Error:", err)
+			return nil, fmt.Errorf("cert error: %w", err)
 		}
 		topic, err := topicFromCertificate(cert)
 		if err != nil {
-			log.Fatalln("Could not parse apns topic from certificate: ", err)
+			return nil, fmt.Errorf("could not parse apns topic from certificate: %w", err)
 		}
 		apns.Topic = topic
+		apns.CertificateExpiry = certificateExpiry(cert)
 		apns.client = apns2.NewClient(cert).Production()
 	} else {
 		if cfg.KeyFileKeyId == "" {
-			log.Fatalln(errors.New("No KeyFileKeyId  found"))
+			return nil, errors.New("No KeyFileKeyId  found")
 		}
 		if cfg.KeyFileTeamId == "" {
-			log.Fatalln(errors.New("No KeyFileTeamId found"))
+			return nil, errors.New("No KeyFileTeamId found")
 		}
 		if cfg.KeyFileTopic == "" {
-			log.Fatalln(errors.New("No KeyFileTopic found"))
+			return nil, errors.New("No KeyFileTopic found")
 		}
 		log.Debugln("Loading Keyfile")
 		authKey, err := token.AuthKeyFromFile("/etc/xapsd/" + cfg.KeyFileP8)
 		if err != nil {
-			log.Fatal("Token error:", err)
+			return nil, fmt.Errorf("token error: %w", err)
 		}
 		apnsToken := &token.Token{
 			AuthKey: authKey,
@@ -119,55 +128,134 @@ func NewApns(cfg *config.Config, db *database.Database) (apns *Apns) {
 	//}
 	//apns.client.HTTPClient.Transport.(*http2.Transport).TLSClientConfig.RootCAs = rootCAs
 
-	apns.createDelayedNotificationThread()
-	return apns
+	return apns, nil
 }
 
-func (apns *Apns) createDelayedNotificationThread() {
-	delayedNotificationTicker := time.NewTicker(time.Second * time.Duration(apns.CheckDelayedInterval))
-	go func() {
-		for range delayedNotificationTicker.C {
-			apns.checkDelayed()
+// NewSubtopicApns creates the notifiers of the calendar and contacts
+// subtopics with a configured certificate
+func NewSubtopicApns(cfg *config.Config) ([]*Apns, error) {
+	var notifiers []*Apns
+	for subtopic, files := range subtopicCertificates(cfg) {
+		apns, err := newSubtopicApns(subtopic, files)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", subtopic, err)
 		}
-	}()
-}
-
-func (apns *Apns) checkDelayed() {
-	log.Debugln("Checking all delayed APNS")
-	var sendNow []database.Registration
-	apns.mapMutex.Lock()
-	for reg, t := range apns.delayedApns {
-		log.Debugln("Registration", reg.AccountId, "/", reg.DeviceToken, "has been waiting for", time.Since(t))
-		if time.Since(t) > time.Second*time.Duration(apns.DelayTime) {
-			sendNow = append(sendNow, reg)
-			delete(apns.delayedApns, reg)
+		notifiers = append(notifiers, apns)
+	}
+	return notifiers, nil
+}
+
+// subtopicCertificates returns the certificates of the enabled calendar
+// and contacts subtopics
+func subtopicCertificates(cfg *config.Config) map[string]config.ApnsCertificate {
+	certificates := make(map[string]config.ApnsCertificate)
+	for subtopic, files := range map[string]config.ApnsCertificate{
+		subtopicCalendar: cfg.CalendarPush,
+		subtopicContacts: cfg.ContactsPush,
+	} {
+		if files.CertificateFileP12 != "" || files.CertificateFilePem != "" {
+			certificates[subtopic] = files
 		}
 	}
-	apns.mapMutex.Unlock()
-	for _, reg := range sendNow {
-		apns.SendNotification(reg, false)
+	return certificates
+}
+
+func newSubtopicApns(subtopic string, files config.ApnsCertificate) (*Apns, error) {
+	cert, err := loadCertificate(files)
+	if err != nil {
+		return nil, err
+	}
+	topic, err := topicFromCertificate(cert)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse apns topic from certificate: %w", err)
 	}
+	log.Debugln("Topic of", subtopic, "is", topic)
+	return &Apns{
+		Topic:             topic,
+		subtopic:          subtopic,
+		client:            apns2.NewClient(cert).Production(),
+		CertificateExpiry: certificateExpiry(cert),
+	}, nil
 }
 
-func (apns *Apns) SendNotification(registration database.Registration, delayed bool) {
-	apns.mapMutex.Lock()
-	if delayed {
-		apns.delayedApns[registration] = time.Now()
-		apns.mapMutex.Unlock()
+// loadCertificate reads the P12 or PEM encoded certificate below /etc/xapsd/
+func loadCertificate(files config.ApnsCertificate) (tls.Certificate, error) {
+	if files.CertificateFileP12 != "" {
+		log.Debugf("Loading Certificate at %s", "/etc/xapsd/"+files.CertificateFileP12)
+		return certificate.FromP12File("/etc/xapsd/"+files.CertificateFileP12, "")
+	}
+	log.Debugf("Loading Certificate at %s", "/etc/xapsd/"+files.CertificateFilePem)
+	certData, err := ioutil.ReadFile("/etc/xapsd/" + files.CertificateFilePem)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyData, err := ioutil.ReadFile("/etc/xapsd/" + files.CertificateFilePemKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("key error: %w", err)
+	}
+	return tls.X509KeyPair(certData, keyData)
+}
+
+// topic returns the topic of the notifications
+func (apns *Apns) topic() string {
+	apns.mutex.RLock()
+	defer apns.mutex.RUnlock()
+	return apns.Topic
+}
+
+// certificateExpiry returns the expiry of the certificate, it is zero for
+// token based authentication
+func (apns *Apns) certificateExpiry() time.Time {
+	apns.mutex.RLock()
+	defer apns.mutex.RUnlock()
+	return apns.CertificateExpiry
+}
+
+// update replaces the credentials by the ones of reloaded
+func (apns *Apns) update(reloaded *Apns) {
+	apns.mutex.Lock()
+	defer apns.mutex.Unlock()
+	if apns.Topic != reloaded.Topic {
+		log.Infoln("Topic of", apns.subtopic, "changed from", apns.Topic, "to", reloaded.Topic)
+	}
+	apns.Topic, apns.client, apns.CertificateExpiry = reloaded.Topic, reloaded.client, reloaded.CertificateExpiry
+	apns.recordCertificateExpiry()
+}
+
+// recordCertificateExpiry exports the expiry of the mail certificate, it is 0
+// for token based authentication
+func (apns *Apns) recordCertificateExpiry() {
+	if apns.subtopic != subtopicMail {
 		return
-	} else {
-		delete(apns.delayedApns, registration)
-		apns.mapMutex.Unlock()
 	}
-	log.Debugln("Sending notification to", registration.AccountId, "/", registration.DeviceToken)
+	if apns.CertificateExpiry.IsZero() {
+		metrics.CertificateExpiry.Set(0)
+		return
+	}
+	metrics.CertificateExpiry.Set(float64(apns.CertificateExpiry.Unix()))
+}
+
+// Backend implements Notifier
+func (apns *Apns) Backend() string {
+	if backend, ok := subtopicBackends[apns.subtopic]; ok {
+		return backend
+	}
+	return backendApns
+}
+
+// Push sends a notification to the registration without delay and returns
+// the response of Apple
+func (apns *Apns) Push(logger *log.Entry, registration database.Registration) (PushOutcome, error) {
+	logger.Debugln("Sending notification to", registration.AccountId, "/", registration.DeviceToken)
+
+	apns.mutex.RLock()
+	topic, client := apns.Topic, apns.client
+	apns.mutex.RUnlock()
 
 	notification := &apns2.Notification{}
 	notification.DeviceToken = registration.DeviceToken
-	notification.Topic = apns.Topic
-	composedPayload := []byte(`{"aps":{`)
-	composedPayload = append(composedPayload, []byte(`"account-id":"`+registration.AccountId+`"`)...)
-	composedPayload = append(composedPayload, []byte(`}}`)...)
-	notification.Payload = composedPayload
+	notification.Topic = topic
+	notification.Payload = apns.payload(registration)
 	notification.PushType = apns2.PushTypeBackground
 	notification.Expiration = time.Now().Add(24 * time.Hour)
 	// set the apns-priority
@@ -175,24 +263,65 @@ func (apns *Apns) SendNotification(registration database.Registration, delayed b
 
 	if log.IsLevelEnabled(log.DebugLevel) {
 		dbgstr, _ := notification.MarshalJSON()
-		log.Debugf("Sending: %s", dbgstr)
+		logger.Debugf("Sending: %s", dbgstr)
 	}
-	res, err := apns.client.Push(notification)
+	start := time.Now()
+	res, err := client.Push(notification)
+	metrics.ApnsRequestDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
-		log.Fatal("Error:", err)
+		return apns.record(apns.Backend(), PushOutcome{Error: err.Error()}), retryable(err)
 	}
+	outcome := apns.record(apns.Backend(), PushOutcome{StatusCode: res.StatusCode, Reason: res.Reason, Id: res.ApnsID})
 
+	logger = logger.WithField("apns_id", res.ApnsID)
 	switch res.StatusCode {
 	case http.StatusOK:
-		log.Debugln("Apple returned 200 for notification to", registration.AccountId, "/", registration.DeviceToken)
-	case 410:
+		logger.Debugln("Apple returned 200 for notification to", registration.AccountId, "/", registration.DeviceToken)
+		return outcome, nil
+	case http.StatusGone:
 		// The device token is inactive for the specified topic.
-		log.Infoln("Apple returned 410 for notification to", registration.AccountId, "/", registration.DeviceToken)
-		apns.db.DeleteIfExistRegistration(registration)
+		logger.Infoln("Apple returned 410 for notification to", registration.AccountId, "/", registration.DeviceToken)
+		return outcome, fmt.Errorf("%w: %s", errGone, res.Reason)
 	default:
-		log.Errorf("Apple returned a non-200 HTTP status: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+		logger.Errorf("Apple returned a non-200 HTTP status: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+		if res.StatusCode == http.StatusNotFound {
+			// unlike other push services Apple uses 404 for an invalid path
+			return outcome, fmt.Errorf("apple returned %d %s", res.StatusCode, res.Reason)
+		}
+		return outcome, statusError(res.StatusCode, res.Reason)
+	}
+}
+
+// payload returns the notification of the registration in the format of the subtopic
+func (apns *Apns) payload(registration database.Registration) []byte {
+	if apns.Backend() != backendApns {
+		// the format of the CalDAV and CardDAV push of the Calendar Server
+		now := time.Now().Unix()
+		payload, _ := json.Marshal(map[string]interface{}{
+			"key":                           registration.PushKey,
+			"dataChangedTimestamp":          now,
+			"pushRequestSubmittedTimestamp": now,
+		})
+		return payload
 	}
+	// marshal the payload as registrations stored by older versions were not validated
+	payload, _ := json.Marshal(map[string]map[string]string{
+		"aps": {"account-id": registration.AccountId},
+	})
+	return payload
+}
+
+func certificateExpiry(tlsCert tls.Certificate) time.Time {
+	if len(tlsCert.Certificate) == 0 {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		log.Fatalln("Could not parse certificate: ", err)
+	}
+	log.Infoln("Certificate valid until", cert.NotAfter)
+	return cert.NotAfter
 }
 
 func topicFromCertificate(tlsCert tls.Certificate) (string, error) {
@@ -204,7 +333,11 @@ func topicFromCertificate(tlsCert tls.Certificate) (string, error) {
 	if err != nil {
 		log.Fatalln("Could not parse certificate: ", err)
 	}
+	return uidTopic(cert)
+}
 
+// uidTopic returns the topic stored in the UID of the subject
+func uidTopic(cert *x509.Certificate) (string, error) {
 	if len(cert.Subject.Names) == 0 {
 		return "", errors.New("Subject.Names is empty")
 	}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApns_CertificateExpiry(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	mail := &Apns{subtopic: subtopicMail}
+	mail.update(&Apns{subtopic: subtopicMail, Topic: "com.apple.mail.XServer.1", CertificateExpiry: expiry})
+	if value := testutil.ToFloat64(metrics.CertificateExpiry); value != float64(expiry.Unix()) {
+		t.Error("Expected the expiry of the mail certificate, got", value)
+	}
+
+	// the certificates of other subtopics are not exported
+	calendar := &Apns{subtopic: subtopicCalendar}
+	calendar.update(&Apns{subtopic: subtopicCalendar, CertificateExpiry: expiry.AddDate(1, 0, 0)})
+	if value := testutil.ToFloat64(metrics.CertificateExpiry); value != float64(expiry.Unix()) {
+		t.Error("Expiry overwritten by the calendar certificate:", value)
+	}
+
+	// reloading with a token key resets the expiry
+	mail.update(&Apns{subtopic: subtopicMail, Topic: "com.apple.mail.XServer.1"})
+	if value := testutil.ToFloat64(metrics.CertificateExpiry); value != 0 {
+		t.Error("Expected no expiry for token based authentication, got", value)
+	}
+}
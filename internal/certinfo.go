@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/sideshow/apns2/token"
+)
+
+// environments of APNs a certificate is valid for
+const (
+	environmentProduction = "production"
+	environmentSandbox    = "sandbox"
+)
+
+// CertificateInfo describes the credentials of a subtopic
+type CertificateInfo struct {
+	Subtopic string
+	// File is the certificate or the key file for token based authentication
+	File string
+	// Topic is read from the UID of the certificate subject
+	Topic     string    `json:",omitempty"`
+	Subject   string    `json:",omitempty"`
+	Issuer    string    `json:",omitempty"`
+	NotBefore time.Time `json:",omitzero"`
+	NotAfter  time.Time `json:",omitzero"`
+	// DaysLeft until NotAfter, negative once the certificate expired and
+	// zero for token based authentication
+	DaysLeft int
+	// Environments are production and sandbox, depending on the extensions
+	// of the certificate
+	Environments []string `json:",omitempty"`
+	// KeyType of the certificate or of the token key, e.g. RSA 2048
+	KeyType string `json:",omitempty"`
+	// KeyId and TeamId of token based authentication
+	KeyId  string `json:",omitempty"`
+	TeamId string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// TokenBased returns whether the info describes a key for token based authentication
+func (info CertificateInfo) TokenBased() bool {
+	return info.KeyId != ""
+}
+
+// CertificateInfos loads the credentials of the mail subtopic and of the
+// enabled calendar and contacts subtopics like NewApns. Credentials that
+// can't be loaded are reported by Error.
+func CertificateInfos(cfg *config.Config) []CertificateInfo {
+	mail := config.ApnsCertificate{
+		CertificateFileP12:    cfg.CertificateFileP12,
+		CertificateFilePem:    cfg.CertificateFilePem,
+		CertificateFilePemKey: cfg.CertificateFilePemKey,
+	}
+	var infos []CertificateInfo
+	if mail.CertificateFileP12 == "" && mail.CertificateFilePem == "" {
+		infos = append(infos, tokenInfo(cfg))
+	} else {
+		infos = append(infos, certificateInfo(subtopicMail, mail))
+	}
+	certificates := subtopicCertificates(cfg)
+	for _, subtopic := range []string{subtopicCalendar, subtopicContacts} {
+		if files, ok := certificates[subtopic]; ok {
+			infos = append(infos, certificateInfo(subtopic, files))
+		}
+	}
+	return infos
+}
+
+func tokenInfo(cfg *config.Config) CertificateInfo {
+	info := CertificateInfo{
+		Subtopic: subtopicMail,
+		File:     "/etc/xapsd/" + cfg.KeyFileP8,
+		Topic:    cfg.KeyFileTopic,
+		KeyId:    cfg.KeyFileKeyId,
+		TeamId:   cfg.KeyFileTeamId,
+	}
+	authKey, err := token.AuthKeyFromFile(info.File)
+	if err != nil {
+		info.Error = fmt.Sprintf("token error: %s", err)
+		return info
+	}
+	info.KeyType = keyType(authKey.Public())
+	return info
+}
+
+func certificateInfo(subtopic string, files config.ApnsCertificate) CertificateInfo {
+	info := CertificateInfo{Subtopic: subtopic, File: "/etc/xapsd/" + files.CertificateFileP12}
+	if files.CertificateFileP12 == "" {
+		info.File = "/etc/xapsd/" + files.CertificateFilePem
+	}
+	tlsCert, err := loadCertificate(files)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	if len(tlsCert.Certificate) > 1 {
+		info.Error = "found multiple certificates in the cert file - only one is allowed"
+		return info
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		info.Error = fmt.Sprintf("could not parse certificate: %s", err)
+		return info
+	}
+	describeCertificate(&info, cert, time.Now())
+	return info
+}
+
+// describeCertificate fills info with the details of cert at now
+func describeCertificate(info *CertificateInfo, cert *x509.Certificate, now time.Time) {
+	info.Subject, info.Issuer = cert.Subject.String(), cert.Issuer.String()
+	info.NotBefore, info.NotAfter = cert.NotBefore, cert.NotAfter
+	info.DaysLeft = int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24))
+	info.KeyType = keyType(cert.PublicKey)
+	info.Environments = nil
+	for _, extension := range cert.Extensions {
+		switch {
+		case extension.Id.Equal(asn1.ObjectIdentifier(productionOID)):
+			info.Environments = append(info.Environments, environmentProduction)
+		case extension.Id.Equal(asn1.ObjectIdentifier(sandboxOID)):
+			info.Environments = append(info.Environments, environmentSandbox)
+		}
+	}
+	topic, err := uidTopic(cert)
+	if err != nil {
+		info.Error = err.Error()
+		return
+	}
+	info.Topic = topic
+}
+
+// keyType returns the algorithm and the size of the public key
+func keyType(publicKey interface{}) string {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", publicKey)
+	}
+}
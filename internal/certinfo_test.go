@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCertificateInfo_Describe(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidUid, Value: "com.apple.mail.XServer.test"}},
+		},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(10*24*time.Hour + time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier(productionOID), Value: []byte{5, 0}}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Cannot create certificate", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Cannot parse certificate", err)
+	}
+
+	var info CertificateInfo
+	describeCertificate(&info, cert, now)
+	if info.Error != "" || info.Topic != "com.apple.mail.XServer.test" {
+		t.Error("Unexpected topic", info.Topic, info.Error)
+	}
+	if info.DaysLeft != 10 || !info.NotAfter.Equal(template.NotAfter) {
+		t.Error("Unexpected validity", info.DaysLeft, info.NotAfter)
+	}
+	if !reflect.DeepEqual(info.Environments, []string{environmentProduction}) {
+		t.Error("Unexpected environments", info.Environments)
+	}
+	if info.KeyType != "ECDSA P-256" || info.TokenBased() {
+		t.Error("Unexpected key type", info.KeyType)
+	}
+
+	describeCertificate(&info, cert, now.Add(11*24*time.Hour))
+	if info.DaysLeft != -1 {
+		t.Error("Expected an expired certificate, got", info.DaysLeft)
+	}
+}
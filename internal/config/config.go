@@ -1,6 +1,9 @@
 package config
 
 import (
+	"errors"
+	"os"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -9,43 +12,209 @@ var conf Config
 
 type (
 	Config struct {
-		loaded                bool
-		LogLevel              string
-		DatabaseFile          string
-		Port                  string
-		ListenAddr            string
-		CheckInterval         uint
-		Delay                 uint
-		CertificateFileP12    string
-		CertificateFilePem    string
-		CertificateFilePemKey string
-		KeyFileP8             string
-		KeyFileTopic          string
-		KeyFileKeyId          string
-		KeyFileTeamId         string
-		TlsCertfile           string
-		TlsKeyfile            string
-		TlsPort               string
-		TlsListenAddr         string
+		loaded                       bool
+		LogLevel                     string             `yaml:"logLevel"`
+		DatabaseFile                 string             `yaml:"databaseFile"`
+		Port                         string             `yaml:"port"`
+		ListenAddr                   string             `yaml:"listenAddr"`
+		CheckInterval                uint               `yaml:"checkInterval"`
+		Delay                        uint               `yaml:"delay"`
+		PushRetries                  uint               `yaml:"pushRetries"`
+		PushRetryInterval            uint               `yaml:"pushRetryInterval"`
+		WebPushVapidKeyFile          string             `yaml:"webPushVapidKeyFile"`
+		WebPushVapidSubject          string             `yaml:"webPushVapidSubject"`
+		WebPushTtl                   uint               `yaml:"webPushTtl"`
+		CertificateFileP12           string             `yaml:"certificateFileP12"`
+		CertificateFilePem           string             `yaml:"certificateFilePem"`
+		CertificateFilePemKey        string             `yaml:"certificateFilePemKey"`
+		KeyFileP8                    string             `yaml:"keyFileP8"`
+		KeyFileTopic                 string             `yaml:"keyFileTopic"`
+		KeyFileKeyId                 string             `yaml:"keyFileKeyId"`
+		KeyFileTeamId                string             `yaml:"keyFileTeamId"`
+		TlsCertfile                  string             `yaml:"tlsCertfile"`
+		TlsKeyfile                   string             `yaml:"tlsKeyfile"`
+		TlsPort                      string             `yaml:"tlsPort"`
+		TlsListenAddr                string             `yaml:"tlsListenAddr"`
+		TlsClientCAFile              string             `yaml:"tlsClientCAFile"`
+		TlsAllowedSubjects           []string           `yaml:"tlsAllowedSubjects"`
+		TlsAllowedSANs               []string           `yaml:"tlsAllowedSANs"`
+		TlsMinVersion                string             `yaml:"tlsMinVersion"`
+		TlsCipherSuites              []string           `yaml:"tlsCipherSuites"`
+		TlsReloadInterval            uint               `yaml:"tlsReloadInterval"`
+		AdminListenAddr              string             `yaml:"adminListenAddr"`
+		AdminPort                    string             `yaml:"adminPort"`
+		AdminUser                    string             `yaml:"adminUser"`
+		AdminPasswordHash            string             `yaml:"adminPasswordHash"`
+		HealthCertExpiryDays         uint               `yaml:"healthCertExpiryDays"`
+		HealthMaxQueueSize           uint               `yaml:"healthMaxQueueSize"`
+		HttpReadHeaderTimeout        uint               `yaml:"httpReadHeaderTimeout"`
+		HttpReadTimeout              uint               `yaml:"httpReadTimeout"`
+		HttpWriteTimeout             uint               `yaml:"httpWriteTimeout"`
+		HttpIdleTimeout              uint               `yaml:"httpIdleTimeout"`
+		HttpMaxHeaderBytes           uint               `yaml:"httpMaxHeaderBytes"`
+		HttpMaxBodyBytes             uint               `yaml:"httpMaxBodyBytes"`
+		HttpMaxConnections           uint               `yaml:"httpMaxConnections"`
+		LegacySocket                 string             `yaml:"legacySocket"`
+		LegacySocketGroup            string             `yaml:"legacySocketGroup"`
+		UsernameCaseFolding          bool               `yaml:"usernameCaseFolding"`
+		UsernameIdna                 bool               `yaml:"usernameIdna"`
+		UsernameDefaultDomain        string             `yaml:"usernameDefaultDomain"`
+		UsernameDomainMode           string             `yaml:"usernameDomainMode"`
+		UsernameAliasFile            string             `yaml:"usernameAliasFile"`
+		NotificationPolicy           NotificationPolicy `yaml:"notificationPolicy"`
+		RateLimits                   RateLimits         `yaml:"rateLimits"`
+		HttpMaxRequestsPerConnection uint               `yaml:"httpMaxRequestsPerConnection"`
+		UnifiedPushEnabled           bool               `yaml:"unifiedPushEnabled"`
+		UnifiedPushAllowedHosts      []string           `yaml:"unifiedPushAllowedHosts"`
+		UnifiedPushAllowHttp         bool               `yaml:"unifiedPushAllowHttp"`
+		CalendarPush                 ApnsCertificate    `yaml:"calendarPush"`
+		ContactsPush                 ApnsCertificate    `yaml:"contactsPush"`
+		WatchConfig                  bool               `yaml:"watchConfig"`
+	}
+
+	// ApnsCertificate names the certificate used for the notifications of a
+	// subtopic. The files are relative to /etc/xapsd/, the subtopic is
+	// disabled if no file is set.
+	ApnsCertificate struct {
+		CertificateFileP12    string `yaml:"certificateFileP12"`
+		CertificateFilePem    string `yaml:"certificateFilePem"`
+		CertificateFilePemKey string `yaml:"certificateFilePemKey"`
+	}
+
+	// EventPolicy defines how a push event is handled, Action is one of
+	// immediate, delayed or ignore. Delay overrides the global delay
+	// for delayed events in seconds.
+	EventPolicy struct {
+		Action string `yaml:"action"`
+		Delay  uint   `yaml:"delay"`
+	}
+
+	// MailboxPolicy overrides the global policy for a mailbox
+	MailboxPolicy struct {
+		Default EventPolicy            `yaml:"default"`
+		Events  map[string]EventPolicy `yaml:"events"`
+	}
+
+	// NotificationPolicy maps push events to the way they are handled.
+	// Event and mailbox names are case-insensitive.
+	NotificationPolicy struct {
+		Default   EventPolicy              `yaml:"default"`
+		Events    map[string]EventPolicy   `yaml:"events"`
+		Mailboxes map[string]MailboxPolicy `yaml:"mailboxes"`
+	}
+
+	// RateLimit is a token bucket refilled with Rate requests per minute
+	// holding up to Burst requests. A Rate of 0 disables the limit.
+	RateLimit struct {
+		Rate  uint `yaml:"rate"`
+		Burst uint `yaml:"burst"`
+	}
+
+	// EndpointRateLimits are applied to all requests of an endpoint
+	EndpointRateLimits struct {
+		Global     RateLimit `yaml:"global"`
+		PerAddress RateLimit `yaml:"perAddress"`
+		PerUser    RateLimit `yaml:"perUser"`
+	}
+
+	// RateLimits configures the limits of the register and notify endpoints
+	RateLimits struct {
+		Register EndpointRateLimits `yaml:"register"`
+		Notify   EndpointRateLimits `yaml:"notify"`
 	}
 )
 
-func ParseConfig(configName, configPath string) {
-	viper.SetConfigType("yaml")
-	viper.SetConfigName("xapsd")
-	viper.SetConfigName(configName)
-	viper.AddConfigPath("/etc/xapsd/")
-	viper.AddConfigPath(configPath)
+// defaults of the options documented in xapsd.yaml, the dumped
+// configuration shows them for options missing in the config file
+var defaults = map[string]interface{}{
+	"logLevel":              "info",
+	"httpReadHeaderTimeout": 10,
+	"httpReadTimeout":       30,
+	"httpWriteTimeout":      30,
+	"httpIdleTimeout":       300,
+	"httpMaxHeaderBytes":    16384,
+	"httpMaxBodyBytes":      65536,
+	"tlsMinVersion":         "1.2",
+	"tlsReloadInterval":     60,
+	"healthCertExpiryDays":  7,
+	"healthMaxQueueSize":    10000,
+	"usernameDomainMode":    "keep",
+	"pushRetries":           3,
+	"pushRetryInterval":     10,
+	"webPushTtl":            86400,
+}
 
-	err := viper.ReadInConfig()
+// settings holds the merged options of the last ParseConfig
+var settings = viper.New()
+
+// configName and configPath of the last ParseConfig, used by Reload
+var lastConfigName, lastConfigPath string
+
+// ParseConfig merges the options of all sources. The config file is
+// optional unless configName is given. Options are taken from, in order
+// of precedence:
+//
+//  1. command line flags registered by RegisterFlags
+//  2. XAPSD_* environment variables and the files named by XAPSD_*_FILE
+//  3. the config file
+//  4. the defaults
+func ParseConfig(configName, configPath string) {
+	cfg, err := loadConfig(configName, configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = viper.Unmarshal(&conf)
+	conf = cfg
+}
+
+// Reload parses the config of the last ParseConfig again. The current
+// options are kept if the new config can't be parsed or is invalid.
+func Reload() (Config, error) {
+	cfg, err := loadConfig(lastConfigName, lastConfigPath)
 	if err != nil {
-		log.Fatal(err)
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
 	}
-	conf.loaded = true
+	conf = cfg
+	return cfg, nil
+}
+
+func loadConfig(configName, configPath string) (Config, error) {
+	parsed := viper.New()
+	for key, value := range defaults {
+		parsed.SetDefault(key, value)
+	}
+	parsed.SetConfigType("yaml")
+	parsed.SetConfigName("xapsd")
+	parsed.SetConfigName(configName)
+	parsed.AddConfigPath("/etc/xapsd/")
+	parsed.AddConfigPath(configPath)
+
+	err := parsed.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if errors.As(err, &notFound) && configName == "" {
+		log.Infoln("No config file found, using environment variables and flags only")
+	} else if err != nil {
+		return Config{}, err
+	}
+	if err := bindEnvironment(parsed, os.Environ()); err != nil {
+		return Config{}, err
+	}
+	applyFlags(parsed)
+
+	var cfg Config
+	if err := parsed.Unmarshal(&cfg); err != nil {
+		return Config{}, err
+	}
+	cfg.loaded = true
+	settings, lastConfigName, lastConfigPath = parsed, configName, configPath
+	return cfg, nil
+}
+
+// FileUsed returns the path of the parsed config file
+func FileUsed() string {
+	return settings.ConfigFileUsed()
 }
 
 func GetOptions() Config {
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -11,3 +14,95 @@ func TestConfig_GetOptions(t *testing.T) {
 		t.Error("Config not loaded")
 	}
 }
+
+func TestConfig_NotificationPolicy(t *testing.T) {
+	ParseConfig("testconf", "./")
+	policy := GetOptions().NotificationPolicy
+	if policy.Events["messageappend"].Action != "delayed" || policy.Events["messageappend"].Delay != 60 {
+		t.Error("Event policy not loaded:", policy.Events)
+	}
+	if policy.Mailboxes["sent"].Default.Action != "ignore" {
+		t.Error("Mailbox policy not loaded:", policy.Mailboxes)
+	}
+}
+
+func validConfig() Config {
+	return Config{
+		LogLevel:      "info",
+		DatabaseFile:  "/var/lib/xapsd/database.json",
+		Port:          "11619",
+		CheckInterval: 20,
+		KeyFileP8:     "key.p8",
+		KeyFileTopic:  "com.apple.mail.nil",
+		KeyFileKeyId:  "ABCDEFGH",
+		KeyFileTeamId: "ABCDEFGH",
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	ParseConfig("testconf", "./")
+	options := GetOptions()
+	if err := options.Validate(); err != nil {
+		t.Error("Valid config rejected:", err)
+	}
+
+	for _, test := range []struct {
+		message string
+		modify  func(cfg *Config)
+	}{
+		{"checkInterval: must be at least 1 second", func(cfg *Config) { cfg.CheckInterval = 0 }},
+		{"port: invalid port 70000", func(cfg *Config) { cfg.Port = "70000" }},
+		{"certificateFilePemKey: required by certificateFilePem", func(cfg *Config) { cfg.KeyFileP8, cfg.CertificateFilePem = "", "cert.pem" }},
+		{"certificateFileP12: only one of certificateFileP12, certificateFilePem and keyFileP8 may be set", func(cfg *Config) { cfg.CertificateFileP12 = "cert.p12" }},
+		{"keyFileTeamId: required by keyFileP8", func(cfg *Config) { cfg.KeyFileTeamId = "" }},
+		{"tlsPort: required by tlsCertfile", func(cfg *Config) { cfg.TlsCertfile, cfg.TlsKeyfile = "cert.pem", "key.pem" }},
+		{"tlsKeyfile: required by tlsCertfile", func(cfg *Config) { cfg.TlsCertfile, cfg.TlsPort = "cert.pem", "11620" }},
+		{"adminPasswordHash: required by adminPort, generate it with xapsd hash-password", func(cfg *Config) { cfg.AdminPort, cfg.AdminUser = "11621", "admin" }},
+		{"unifiedPushAllowedHosts: required by unifiedPushEnabled, e.g. the host of your ntfy server", func(cfg *Config) { cfg.UnifiedPushEnabled = true }},
+		{"calendarPush.certificateFilePemKey: required by certificateFilePem", func(cfg *Config) { cfg.CalendarPush.CertificateFilePem = "calendar.pem" }},
+		{"notificationPolicy.events.messagenew.action: unknown action now, use immediate, delayed or ignore", func(cfg *Config) {
+			cfg.NotificationPolicy.Events = map[string]EventPolicy{"messagenew": {Action: "now"}}
+		}},
+	} {
+		cfg := validConfig()
+		test.modify(&cfg)
+		if err := cfg.Validate(); err == nil || err.Error() != test.message {
+			t.Errorf("Expected %q, got %v", test.message, err)
+		}
+	}
+
+	if err := (&Config{}).Validate(); err == nil || len(err.(interface{ Unwrap() []error }).Unwrap()) != 5 {
+		t.Error("Expected all errors of an empty config, got", err)
+	}
+}
+
+func TestConfig_TlsMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "xapsd.yaml"), []byte("tlsMinVersion: 1.0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfig("xapsd", dir)
+	if err != nil {
+		t.Fatal("Cannot load config", err)
+	}
+	cfg := validConfig()
+	cfg.TlsMinVersion = loaded.TlsMinVersion
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unquoted tlsMinVersion %q rejected: %s", loaded.TlsMinVersion, err)
+	}
+}
+
+func TestConfig_Dump(t *testing.T) {
+	cfg := validConfig()
+	cfg.AdminPasswordHash = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+	dump, err := cfg.Dump()
+	if err != nil {
+		t.Fatal("Cannot dump config", err)
+	}
+	if strings.Contains(string(dump), cfg.AdminPasswordHash) || !strings.Contains(string(dump), "adminPasswordHash: <redacted>") {
+		t.Error("Secret has not been redacted:", string(dump))
+	}
+	if !strings.Contains(string(dump), "checkInterval: 20") {
+		t.Error("Unexpected dump:", string(dump))
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const envPrefix = "XAPSD_"
+
+// option is a setting of Config that can be overridden by an environment
+// variable and a flag
+type option struct {
+	// path of the option in the config file, e.g. rateLimits.notify.global.rate
+	key    string
+	isBool bool
+}
+
+// options returns all options of Config besides the maps of the
+// notification policy, which are only read from the config file
+func options() []option {
+	return structOptions(reflect.TypeOf(Config{}), "")
+}
+
+func structOptions(structType reflect.Type, prefix string) []option {
+	var options []option
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key, ok := field.Tag.Lookup("yaml")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		key = prefix + key
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			options = append(options, structOptions(field.Type, key+".")...)
+		case reflect.Map:
+		default:
+			options = append(options, option{key: key, isBool: field.Type.Kind() == reflect.Bool})
+		}
+	}
+	return options
+}
+
+// EnvName returns the environment variable overriding the option, e.g.
+// XAPSD_CHECK_INTERVAL for checkInterval and XAPSD_RATE_LIMITS_NOTIFY_GLOBAL_RATE
+// for rateLimits.notify.global.rate
+func EnvName(key string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+	var previous rune
+	for _, c := range key {
+		switch {
+		case c == '.':
+			name.WriteRune('_')
+		case unicode.IsUpper(c) && (unicode.IsLower(previous) || unicode.IsDigit(previous)):
+			name.WriteRune('_')
+			name.WriteRune(c)
+		default:
+			name.WriteRune(unicode.ToUpper(c))
+		}
+		previous = c
+	}
+	return name.String()
+}
+
+// bindEnvironment sets the options given by XAPSD_* variables of environ.
+// The value of XAPSD_*_FILE variables is read from the named file, e.g.
+// for secrets mounted into a container.
+func bindEnvironment(settings *viper.Viper, environ []string) error {
+	variables := make(map[string]string)
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, envPrefix) {
+			variables[name] = value
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, option := range options() {
+		name := EnvName(option.key)
+		known[name], known[name+"_FILE"] = true, true
+		value, ok := variables[name]
+		if filename, fileOk := variables[name+"_FILE"]; fileOk {
+			if ok {
+				return fmt.Errorf("only one of %s and %s_FILE may be set", name, name)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", name, err)
+			}
+			value, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if ok {
+			settings.Set(option.key, value)
+		}
+	}
+	for name := range variables {
+		if !known[name] {
+			log.Warnln("Ignoring unknown environment variable", name)
+		}
+	}
+	return nil
+}
+
+// flagValue holds the value of an option given on the command line
+type flagValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (value *flagValue) String() string {
+	return value.value
+}
+
+func (value *flagValue) Set(s string) error {
+	value.value, value.set = s, true
+	return nil
+}
+
+func (value *flagValue) IsBoolFlag() bool {
+	return value.isBool
+}
+
+// flagValues are the flags registered by RegisterFlags by option
+var flagValues = make(map[string]*flagValue)
+
+// RegisterFlags adds a flag for every option to flags, e.g. -checkInterval 20
+// or -rateLimits.notify.global.rate 600. Lists are separated by commas.
+func RegisterFlags(flags *flag.FlagSet) {
+	for _, option := range options() {
+		value := &flagValue{isBool: option.isBool}
+		flagValues[option.key] = value
+		flags.Var(value, option.key, "overrides the option "+option.key+" and "+EnvName(option.key))
+	}
+}
+
+// applyFlags sets the options given on the command line
+func applyFlags(settings *viper.Viper) {
+	for key, value := range flagValues {
+		if value.set {
+			settings.Set(key, value.value)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnv_EnvName(t *testing.T) {
+	for key, name := range map[string]string{
+		"checkInterval":                     "XAPSD_CHECK_INTERVAL",
+		"certificateFileP12":                "XAPSD_CERTIFICATE_FILE_P12",
+		"tlsAllowedSANs":                    "XAPSD_TLS_ALLOWED_SANS",
+		"rateLimits.notify.perAddress.rate": "XAPSD_RATE_LIMITS_NOTIFY_PER_ADDRESS_RATE",
+	} {
+		if EnvName(key) != name {
+			t.Errorf("Expected %s for %s, got %s", name, key, EnvName(key))
+		}
+	}
+}
+
+func TestEnv_Precedence(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "hash")
+	if err := os.WriteFile(secret, []byte("5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XAPSD_CHECK_INTERVAL", "5")
+	t.Setenv("XAPSD_DELAY", "10")
+	t.Setenv("XAPSD_ADMIN_PASSWORD_HASH_FILE", secret)
+	t.Setenv("XAPSD_TLS_ALLOWED_SANS", "a.example.org,b.example.org")
+	t.Setenv("XAPSD_RATE_LIMITS_NOTIFY_GLOBAL_RATE", "600")
+
+	flags := flag.NewFlagSet("xapsd", flag.ContinueOnError)
+	RegisterFlags(flags)
+	t.Cleanup(func() { flagValues = make(map[string]*flagValue) })
+	if err := flags.Parse([]string{"-delay", "15", "-unifiedPushEnabled"}); err != nil {
+		t.Fatal("Cannot parse flags", err)
+	}
+
+	ParseConfig("testconf", "./")
+	options := GetOptions()
+	// the environment overrides the config file, flags override the environment
+	if options.CheckInterval != 5 || options.Delay != 15 || !options.UnifiedPushEnabled {
+		t.Error("Unexpected precedence", options.CheckInterval, options.Delay, options.UnifiedPushEnabled)
+	}
+	if options.AdminPasswordHash != "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8" {
+		t.Error("Secret file not read:", options.AdminPasswordHash)
+	}
+	if len(options.TlsAllowedSANs) != 2 || options.RateLimits.Notify.Global.Rate != 600 {
+		t.Error("Unexpected options", options.TlsAllowedSANs, options.RateLimits.Notify.Global)
+	}
+	// unset options keep the values of the config file
+	if options.KeyFileTopic != "com.apple.mail.nil" {
+		t.Error("Config file not read")
+	}
+}
+
+func TestEnv_Conflict(t *testing.T) {
+	environ := []string{"XAPSD_ADMIN_PASSWORD_HASH=abc", "XAPSD_ADMIN_PASSWORD_HASH_FILE=/nonexistent"}
+	if err := bindEnvironment(settings, environ); err == nil {
+		t.Error("Conflicting variables accepted")
+	}
+	if err := bindEnvironment(settings, []string{"XAPSD_ADMIN_PASSWORD_HASH_FILE=/nonexistent"}); err == nil {
+		t.Error("Missing secret file accepted")
+	}
+}
+
+func TestEnv_WithoutConfigFile(t *testing.T) {
+	t.Setenv("XAPSD_DATABASE_FILE", "/tmp/database.json")
+	ParseConfig("", t.TempDir())
+	options := GetOptions()
+	if options.DatabaseFile != "/tmp/database.json" || options.LogLevel != "info" {
+		t.Error("Unexpected options without config file", options.DatabaseFile, options.LogLevel)
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Changes returns the options differing between old and new, e.g.
+// checkInterval or rateLimits.notify.global.rate. The maps of the
+// notification policy are compared as a whole, e.g. notificationPolicy.events.
+func Changes(old, new Config) []string {
+	return structChanges(reflect.ValueOf(old), reflect.ValueOf(new), "")
+}
+
+func structChanges(old, new reflect.Value, prefix string) []string {
+	var changes []string
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		key, ok := field.Tag.Lookup("yaml")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		key = prefix + key
+		if field.Type.Kind() == reflect.Struct {
+			changes = append(changes, structChanges(old.Field(i), new.Field(i), key+".")...)
+		} else if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changes = append(changes, key)
+		}
+	}
+	return changes
+}
+
+// WatchConfig calls onChange whenever the config file of the last
+// ParseConfig is written. Nothing is watched without a config file.
+func WatchConfig(onChange func()) {
+	watched := settings
+	if watched.ConfigFileUsed() == "" {
+		log.Warnln("Not watching the configuration, no config file is used")
+		return
+	}
+	watched.OnConfigChange(func(event fsnotify.Event) {
+		log.Infoln("Config file", event.Name, "changed")
+		onChange()
+	})
+	watched.WatchConfig()
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReload_Changes(t *testing.T) {
+	old := validConfig()
+	if changes := Changes(old, old); len(changes) != 0 {
+		t.Error("Unexpected changes of an equal config:", changes)
+	}
+
+	new := validConfig()
+	new.CheckInterval = 30
+	new.RateLimits.Notify.Global.Rate = 600
+	new.NotificationPolicy.Events = map[string]EventPolicy{"messagenew": {Action: "delayed"}}
+	new.TlsAllowedSubjects = []string{"CN=dovecot"}
+	expected := []string{"checkInterval", "tlsAllowedSubjects", "notificationPolicy.events", "rateLimits.notify.global.rate"}
+	if changes := Changes(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestReload_Reload(t *testing.T) {
+	ParseConfig("testconf", "./")
+	cfg, err := Reload()
+	if err != nil {
+		t.Fatal("Reload failed:", err)
+	}
+	if changes := Changes(GetOptions(), cfg); len(changes) != 0 || cfg.LogLevel != "info" {
+		t.Error("Unexpected changes after reloading the same config:", changes)
+	}
+
+	ParseConfig("testconf", "./")
+	lastConfigName = "missing"
+	if _, err := Reload(); err == nil {
+		t.Error("Reloading a missing config file succeeded")
+	}
+	if GetOptions().LogLevel != "info" {
+		t.Error("Current options replaced by a failed reload")
+	}
+}
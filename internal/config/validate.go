@@ -0,0 +1,206 @@
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets in the dumped configuration
+const redacted = "<redacted>"
+
+// Validate checks the configuration for missing, invalid and contradicting
+// options. It returns an error for each problem joined by errors.Join.
+func (cfg *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+		add("logLevel: %s", err)
+	}
+	if cfg.DatabaseFile == "" {
+		add("databaseFile: missing")
+	}
+	if cfg.Port == "" {
+		add("port: missing")
+	} else if err := checkPort(cfg.Port); err != nil {
+		add("port: %s", err)
+	}
+	if cfg.CheckInterval == 0 {
+		add("checkInterval: must be at least 1 second")
+	}
+
+	// exactly one way to authenticate at APNs
+	switch {
+	case cfg.CertificateFileP12 != "" && (cfg.CertificateFilePem != "" || cfg.KeyFileP8 != ""):
+		add("certificateFileP12: only one of certificateFileP12, certificateFilePem and keyFileP8 may be set")
+	case cfg.CertificateFilePem != "" && cfg.KeyFileP8 != "":
+		add("certificateFilePem: only one of certificateFilePem and keyFileP8 may be set")
+	case cfg.CertificateFileP12 != "" || cfg.CertificateFilePem != "":
+		errs = append(errs, certificateErrors("", ApnsCertificate{
+			CertificateFileP12:    cfg.CertificateFileP12,
+			CertificateFilePem:    cfg.CertificateFilePem,
+			CertificateFilePemKey: cfg.CertificateFilePemKey,
+		})...)
+	case cfg.KeyFileP8 == "":
+		add("keyFileP8: one of certificateFileP12, certificateFilePem or keyFileP8 is required")
+	default:
+		if cfg.KeyFileTopic == "" {
+			add("keyFileTopic: required by keyFileP8")
+		}
+		if cfg.KeyFileKeyId == "" {
+			add("keyFileKeyId: required by keyFileP8")
+		}
+		if cfg.KeyFileTeamId == "" {
+			add("keyFileTeamId: required by keyFileP8")
+		}
+	}
+	errs = append(errs, certificateErrors("calendarPush.", cfg.CalendarPush)...)
+	errs = append(errs, certificateErrors("contactsPush.", cfg.ContactsPush)...)
+
+	if cfg.TlsCertfile != "" || cfg.TlsKeyfile != "" {
+		if cfg.TlsCertfile == "" {
+			add("tlsCertfile: required by tlsKeyfile")
+		}
+		if cfg.TlsKeyfile == "" {
+			add("tlsKeyfile: required by tlsCertfile")
+		}
+		if cfg.TlsPort == "" {
+			add("tlsPort: required by tlsCertfile")
+		} else if err := checkPort(cfg.TlsPort); err != nil {
+			add("tlsPort: %s", err)
+		}
+	} else if cfg.TlsClientCAFile != "" {
+		add("tlsClientCAFile: requires tlsCertfile and tlsKeyfile")
+	}
+	if cfg.TlsClientCAFile == "" && (len(cfg.TlsAllowedSubjects) > 0 || len(cfg.TlsAllowedSANs) > 0) {
+		add("tlsAllowedSubjects: client certificates are only verified with tlsClientCAFile")
+	}
+	switch cfg.TlsMinVersion {
+	// an unquoted 1.0 in the config file is read as the number 1
+	case "", "1", "1.0", "1.1", "1.2", "1.3":
+	default:
+		add("tlsMinVersion: unknown TLS version %s, use '1.0', '1.1', '1.2' or '1.3'", cfg.TlsMinVersion)
+	}
+
+	if cfg.AdminPort != "" {
+		if err := checkPort(cfg.AdminPort); err != nil {
+			add("adminPort: %s", err)
+		}
+		if cfg.AdminUser == "" {
+			add("adminUser: required by adminPort")
+		}
+		if cfg.AdminPasswordHash == "" {
+			add("adminPasswordHash: required by adminPort, generate it with xapsd hash-password")
+		} else if hash, err := hex.DecodeString(cfg.AdminPasswordHash); err != nil || len(hash) != 32 {
+			add("adminPasswordHash: must be a hex encoded SHA-256 hash, generate it with xapsd hash-password")
+		}
+	}
+
+	if cfg.LegacySocketGroup != "" && cfg.LegacySocket == "" {
+		add("legacySocketGroup: requires legacySocket")
+	}
+
+	switch strings.ToLower(cfg.UsernameDomainMode) {
+	case "", "keep":
+	case "strip", "append":
+		if cfg.UsernameDefaultDomain == "" {
+			add("usernameDefaultDomain: required by usernameDomainMode %s", cfg.UsernameDomainMode)
+		}
+	default:
+		add("usernameDomainMode: unknown mode %s, use keep, strip or append", cfg.UsernameDomainMode)
+	}
+
+	// the endpoints are chosen by the clients of the plugin socket
+	if cfg.UnifiedPushEnabled && len(cfg.UnifiedPushAllowedHosts) == 0 {
+		add("unifiedPushAllowedHosts: required by unifiedPushEnabled, e.g. the host of your ntfy server")
+	}
+
+	if cfg.WebPushVapidKeyFile != "" {
+		if !strings.HasPrefix(cfg.WebPushVapidSubject, "mailto:") && !strings.HasPrefix(cfg.WebPushVapidSubject, "https:") {
+			add("webPushVapidSubject: must be a mailto: or https: URL")
+		}
+	}
+
+	// the defaults may be left empty, the actions of events are required
+	errs = append(errs, policyErrors("notificationPolicy.default", cfg.NotificationPolicy.Default, true)...)
+	for _, event := range sortedKeys(cfg.NotificationPolicy.Events) {
+		errs = append(errs, policyErrors("notificationPolicy.events."+event, cfg.NotificationPolicy.Events[event], false)...)
+	}
+	for _, mailbox := range sortedKeys(cfg.NotificationPolicy.Mailboxes) {
+		mailboxPolicy := cfg.NotificationPolicy.Mailboxes[mailbox]
+		errs = append(errs, policyErrors("notificationPolicy.mailboxes."+mailbox+".default", mailboxPolicy.Default, true)...)
+		for _, event := range sortedKeys(mailboxPolicy.Events) {
+			errs = append(errs, policyErrors("notificationPolicy.mailboxes."+mailbox+".events."+event, mailboxPolicy.Events[event], false)...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// certificateErrors checks the certificate files of a subtopic, prefix is
+// the path of the options
+func certificateErrors(prefix string, files ApnsCertificate) []error {
+	var errs []error
+	if files.CertificateFileP12 != "" && files.CertificateFilePem != "" {
+		errs = append(errs, fmt.Errorf("%scertificateFileP12: only one of certificateFileP12 and certificateFilePem may be set", prefix))
+	}
+	if files.CertificateFilePem != "" && files.CertificateFilePemKey == "" {
+		errs = append(errs, fmt.Errorf("%scertificateFilePemKey: required by certificateFilePem", prefix))
+	}
+	if files.CertificateFilePem == "" && files.CertificateFilePemKey != "" {
+		errs = append(errs, fmt.Errorf("%scertificateFilePem: required by certificateFilePemKey", prefix))
+	}
+	return errs
+}
+
+func policyErrors(name string, policy EventPolicy, optional bool) []error {
+	switch strings.ToLower(policy.Action) {
+	case "immediate", "delayed", "ignore":
+	case "":
+		if !optional {
+			return []error{fmt.Errorf("%s.action: missing", name)}
+		}
+	default:
+		return []error{fmt.Errorf("%s.action: unknown action %s, use immediate, delayed or ignore", name, policy.Action)}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the map to report errors in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkPort(port string) error {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration without secrets
+func (cfg Config) Redacted() Config {
+	if cfg.AdminPasswordHash != "" {
+		cfg.AdminPasswordHash = redacted
+	}
+	return cfg
+}
+
+// Dump returns the configuration without secrets as YAML
+func (cfg Config) Dump() ([]byte, error) {
+	return yaml.Marshal(cfg.Redacted())
+}
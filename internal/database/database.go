@@ -27,24 +27,58 @@ package database
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
 var dbMutex = &sync.Mutex{}
 
+// ErrBackendConflict is returned when an account id is registered again
+// for another backend, e.g. a calendar registration reusing the id of a
+// mail registration
+var ErrBackendConflict = errors.New("account is registered for another backend")
+
+// DefaultBackend is the push backend of accounts stored without a backend
+const DefaultBackend = "apns"
+
+// Registration identifies a device to notify, Backend is the type of the
+// push backend delivering the notification
 type Registration struct {
 	DeviceToken string
 	AccountId   string
+	Backend     string
+	// Username is the owner of the account, account ids are only unique
+	// per user
+	Username string
+	// PushKey is the changed collection of calendar and contacts registrations
+	PushKey string
 }
 
 type Account struct {
 	DeviceToken      string
 	Mailboxes        []string
 	RegistrationTime time.Time
+	Backend          string `json:",omitempty"`
+	// Keys holds the secrets of backends encrypting their notifications
+	Keys map[string]string `json:",omitempty"`
+	// PushKeys are the calendar and contacts collections the device watches
+	PushKeys []string `json:",omitempty"`
+}
+
+// Registration returns the registration of the account of the user
+func (account *Account) Registration(username, accountId string) Registration {
+	backend := account.Backend
+	if backend == "" {
+		backend = DefaultBackend
+	}
+	return Registration{DeviceToken: account.DeviceToken, AccountId: accountId, Backend: backend, Username: username}
 }
 
 func (account *Account) ContainsMailbox(mailbox string) bool {
@@ -56,6 +90,15 @@ func (account *Account) ContainsMailbox(mailbox string) bool {
 	return false
 }
 
+func (account *Account) ContainsPushKey(pushKey string) bool {
+	for _, k := range account.PushKeys {
+		if k == pushKey {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
 	Accounts map[string]Account
 }
@@ -64,6 +107,8 @@ type Database struct {
 	filename  string
 	Users     map[string]User
 	lastWrite time.Time
+	// keepUntilGone are the backends exempt from the cleanup
+	keepUntilGone map[string]bool
 }
 
 func NewDatabase(filename string) (*Database, error) {
@@ -89,6 +134,7 @@ func NewDatabase(filename string) (*Database, error) {
 			return nil, err
 		}
 	}
+	db.updateMetrics()
 
 	registrationCleanupTicker := time.NewTicker(time.Hour * 8)
 	go func() {
@@ -110,7 +156,47 @@ func (db *Database) write() error {
 	return os.Rename(db.filename+".new", db.filename)
 }
 
+// CheckWritable verifies that the database file can be replaced by a new version
+func (db *Database) CheckWritable() error {
+	f, err := ioutil.TempFile(filepath.Dir(db.filename), filepath.Base(db.filename)+".check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// AddRegistration stores an account notified by the DefaultBackend
 func (db *Database) AddRegistration(username, accountId, deviceToken string, mailboxes []string) (err error) {
+	return db.AddBackendRegistration(DefaultBackend, username, accountId, deviceToken, mailboxes, nil)
+}
+
+// AddBackendRegistration stores an account notified by the backend
+func (db *Database) AddBackendRegistration(backend, username, accountId, deviceToken string, mailboxes []string, keys map[string]string) (err error) {
+	return db.addAccount(username, accountId, Account{
+		DeviceToken: deviceToken,
+		Mailboxes:   mailboxes,
+		Backend:     backend,
+		Keys:        keys,
+	})
+}
+
+// AddPushKeyRegistration stores an account notified by the backend about
+// changes of the calendar or contacts collections identified by pushKeys
+func (db *Database) AddPushKeyRegistration(backend, username, accountId, deviceToken string, pushKeys []string) (err error) {
+	return db.addAccount(username, accountId, Account{
+		DeviceToken: deviceToken,
+		Backend:     backend,
+		PushKeys:    pushKeys,
+	})
+}
+
+func (db *Database) addAccount(username, accountId string, account Account) (err error) {
+	// keep the database readable by older versions
+	if account.Backend == DefaultBackend {
+		account.Backend = ""
+	}
+
 	//  mutual write access to database issue #16 xaps-plugin
 	dbMutex.Lock()
 
@@ -122,19 +208,19 @@ func (db *Database) AddRegistration(username, accountId, deviceToken string, mai
 	}
 
 	// Ensure the Account exists
-	if _, ok := db.Users[username].Accounts[accountId]; !ok {
+	if existing, ok := db.Users[username].Accounts[accountId]; !ok {
 		db.Users[username].Accounts[accountId] = Account{}
+	} else if existing.Backend != account.Backend {
+		dbMutex.Unlock()
+		return ErrBackendConflict
 	} else {
 		log.Debugf("AddRegistration(): Account %s already exists", accountId)
 	}
 
 	// Set or update the Registration
-	db.Users[username].Accounts[accountId] =
-		Account{
-			DeviceToken:      deviceToken,
-			Mailboxes:        mailboxes,
-			RegistrationTime: time.Now(),
-		}
+	account.RegistrationTime = time.Now()
+	db.Users[username].Accounts[accountId] = account
+	db.updateMetrics()
 
 	log.Debugf("AddRegistration(): About to flush db to disk")
 	if db.lastWrite.Before(time.Now().Add(-time.Minute * 15)) {
@@ -149,21 +235,20 @@ func (db *Database) AddRegistration(username, accountId, deviceToken string, mai
 	return
 }
 
+// DeleteIfExistRegistration removes the account of the registration. The
+// account is only looked up among the accounts of reg.Username, unless the
+// registration doesn't name a user.
 func (db *Database) DeleteIfExistRegistration(reg Registration) bool {
 	dbMutex.Lock()
 	for username, user := range db.Users {
+		if reg.Username != "" && username != reg.Username {
+			continue
+		}
 		for accountId, account := range user.Accounts {
 			if accountId == reg.AccountId {
 				log.Infoln("Deleting " + account.DeviceToken)
-				delete(user.Accounts, accountId)
-				// clean up empty users
-				if len(user.Accounts) == 0 {
-					delete(db.Users, username)
-				}
-				err := db.write()
-				if err != nil {
-					log.Error(err)
-				}
+				db.deleteAccount(username, accountId)
+				db.flush()
 				dbMutex.Unlock()
 				return true
 			}
@@ -180,7 +265,7 @@ func (db *Database) FindRegistrations(username, mailbox string) ([]Registration,
 		for accountId, account := range user.Accounts {
 			if account.ContainsMailbox(mailbox) {
 				registrations = append(registrations,
-					Registration{DeviceToken: account.DeviceToken, AccountId: accountId})
+					account.Registration(username, accountId))
 			}
 		}
 	}
@@ -188,6 +273,39 @@ func (db *Database) FindRegistrations(username, mailbox string) ([]Registration,
 	return registrations, nil
 }
 
+// Lookup identifies the registrations of a user interested in a mailbox
+type Lookup struct {
+	Username string
+	Mailbox  string
+}
+
+// LookupResult contains the registrations found for a Lookup
+type LookupResult struct {
+	Registrations []Registration
+	UserExists    bool
+}
+
+// FindRegistrationsBatch resolves multiple lookups while holding the lock only once
+func (db *Database) FindRegistrationsBatch(lookups []Lookup) []LookupResult {
+	results := make([]LookupResult, len(lookups))
+	dbMutex.Lock()
+	for i, lookup := range lookups {
+		user, ok := db.Users[lookup.Username]
+		if !ok {
+			continue
+		}
+		results[i].UserExists = true
+		for accountId, account := range user.Accounts {
+			if account.ContainsMailbox(lookup.Mailbox) {
+				results[i].Registrations = append(results[i].Registrations,
+					account.Registration(lookup.Username, accountId))
+			}
+		}
+	}
+	dbMutex.Unlock()
+	return results
+}
+
 func (db *Database) UserExists(username string) bool {
 	dbMutex.Lock()
 	_, ok := db.Users[username]
@@ -195,19 +313,237 @@ func (db *Database) UserExists(username string) bool {
 	return ok
 }
 
-func (db *Database) cleanupRegistered() {
+// SearchUsers returns a copy of all users whose username, account ids or
+// device tokens contain the query. An empty query returns all users.
+func (db *Database) SearchUsers(query string) map[string]User {
+	users := make(map[string]User)
+	dbMutex.Lock()
+	for username, user := range db.Users {
+		if user.matches(username, query) {
+			users[username] = user.copy()
+		}
+	}
+	dbMutex.Unlock()
+	return users
+}
+
+// GetUser returns a copy of the user and whether it exists
+func (db *Database) GetUser(username string) (User, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	user, ok := db.Users[username]
+	if !ok {
+		return User{}, false
+	}
+	return user.copy(), true
+}
+
+// FindAccount returns a copy of the account of the user with the id
+func (db *Database) FindAccount(username, accountId string) (Account, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	account, ok := db.Users[username].Accounts[accountId]
+	if !ok {
+		return Account{}, false
+	}
+	return account.copy(), true
+}
+
+// FindRegistrationsByDeviceToken returns all registrations using the device token
+func (db *Database) FindRegistrationsByDeviceToken(deviceToken string) []Registration {
+	var registrations []Registration
+	dbMutex.Lock()
+	for username, user := range db.Users {
+		for accountId, account := range user.Accounts {
+			if account.DeviceToken == deviceToken {
+				registrations = append(registrations,
+					account.Registration(username, accountId))
+			}
+		}
+	}
+	dbMutex.Unlock()
+	return registrations
+}
+
+// FindRegistrationsByPushKey returns a registration for each account watching
+// one of the push keys, the registration carries the push key
+func (db *Database) FindRegistrationsByPushKey(pushKeys []string) []Registration {
+	var registrations []Registration
+	dbMutex.Lock()
+	for username, user := range db.Users {
+		for accountId, account := range user.Accounts {
+			for _, pushKey := range pushKeys {
+				if account.ContainsPushKey(pushKey) {
+					registration := account.Registration(username, accountId)
+					registration.PushKey = pushKey
+					registrations = append(registrations, registration)
+				}
+			}
+		}
+	}
+	dbMutex.Unlock()
+	return registrations
+}
+
+// DeleteRegistration removes the account of the user and returns its registration
+func (db *Database) DeleteRegistration(username, accountId string) (Registration, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	user, ok := db.Users[username]
+	if !ok {
+		return Registration{}, false
+	}
+	account, ok := user.Accounts[accountId]
+	if !ok {
+		return Registration{}, false
+	}
+	log.Infoln("Deleting account", accountId, "of user", username)
+	db.deleteAccount(username, accountId)
+	db.flush()
+	return account.Registration(username, accountId), true
+}
+
+// DeleteUser removes all accounts of the user and returns their registrations
+func (db *Database) DeleteUser(username string) []Registration {
+	var registrations []Registration
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	user, ok := db.Users[username]
+	if !ok {
+		return nil
+	}
+	log.Infoln("Deleting user", username)
+	for accountId, account := range user.Accounts {
+		registrations = append(registrations, account.Registration(username, accountId))
+		db.deleteAccount(username, accountId)
+	}
+	db.flush()
+	return registrations
+}
+
+// DeleteDeviceToken removes all accounts using the device token and returns their registrations
+func (db *Database) DeleteDeviceToken(deviceToken string) []Registration {
+	var registrations []Registration
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	for username, user := range db.Users {
+		for accountId, account := range user.Accounts {
+			if account.DeviceToken == deviceToken {
+				log.Infoln("Deleting account", accountId, "of user", username)
+				registrations = append(registrations, account.Registration(username, accountId))
+				db.deleteAccount(username, accountId)
+			}
+		}
+	}
+	if len(registrations) > 0 {
+		db.flush()
+	}
+	return registrations
+}
+
+// deleteAccount removes the account and the user if it has no accounts left,
+// the caller has to hold the dbMutex
+func (db *Database) deleteAccount(username, accountId string) {
+	user := db.Users[username]
+	delete(user.Accounts, accountId)
+	// clean up empty users
+	if len(user.Accounts) == 0 {
+		delete(db.Users, username)
+	}
+	db.updateMetrics()
+}
+
+// flush writes the database to disk and logs errors, the caller has to hold the dbMutex
+func (db *Database) flush() {
+	err := db.write()
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// KeepUntilGone exempts the registrations of the backends from the cleanup.
+// Their clients don't register again on login like the Dovecot plugin does,
+// the registrations are removed once the push service reports them as gone.
+func (db *Database) KeepUntilGone(backends ...string) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if db.keepUntilGone == nil {
+		db.keepUntilGone = make(map[string]bool)
+	}
+	for _, backend := range backends {
+		db.keepUntilGone[backend] = true
+	}
+}
+
+// Cleanup removes all registrations not renewed within 30 days besides the
+// ones of backends kept until gone and returns their count
+func (db *Database) Cleanup() int {
+	return db.cleanupRegistered()
+}
+
+// updateMetrics sets the registration gauges, the caller has to hold the dbMutex
+func (db *Database) updateMetrics() {
+	accounts := 0
+	for _, user := range db.Users {
+		accounts += len(user.Accounts)
+	}
+	metrics.RegisteredUsers.Set(float64(len(db.Users)))
+	metrics.RegisteredAccounts.Set(float64(accounts))
+}
+
+func (user *User) matches(username, query string) bool {
+	if strings.Contains(username, query) {
+		return true
+	}
+	for accountId, account := range user.Accounts {
+		if strings.Contains(accountId, query) || strings.Contains(account.DeviceToken, query) {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) copy() User {
+	accounts := make(map[string]Account, len(user.Accounts))
+	for accountId, account := range user.Accounts {
+		accounts[accountId] = account.copy()
+	}
+	return User{Accounts: accounts}
+}
+
+func (account *Account) copy() Account {
+	accountCopy := *account
+	accountCopy.Mailboxes = append([]string(nil), account.Mailboxes...)
+	accountCopy.PushKeys = append([]string(nil), account.PushKeys...)
+	if account.Keys != nil {
+		accountCopy.Keys = make(map[string]string, len(account.Keys))
+		for name, key := range account.Keys {
+			accountCopy.Keys[name] = key
+		}
+	}
+	return accountCopy
+}
+
+func (db *Database) cleanupRegistered() int {
 	log.Debugln("Check Database for devices not calling IMAP hook for more than 30d")
 	toDelete := make([]Registration, 0)
 	dbMutex.Lock()
-	for _, user := range db.Users {
+	for username, user := range db.Users {
 		for accountId, account := range user.Accounts {
+			if db.keepUntilGone[account.Backend] {
+				continue
+			}
 			if !account.RegistrationTime.IsZero() && account.RegistrationTime.Before(time.Now().Add(-time.Hour*24*30)) {
-				toDelete = append(toDelete, Registration{account.DeviceToken, accountId})
+				toDelete = append(toDelete, account.Registration(username, accountId))
 			}
 		}
 	}
 	dbMutex.Unlock()
+	deleted := 0
 	for _, reg := range toDelete {
-		db.DeleteIfExistRegistration(reg)
+		if db.DeleteIfExistRegistration(reg) {
+			deleted++
+		}
 	}
+	return deleted
 }
@@ -26,11 +26,13 @@
 package database
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 func DBCreateWorkingCopy() {
@@ -190,6 +192,44 @@ func TestDatabase_DeleteIfExistRegistration(t *testing.T) {
 	}
 }
 
+func TestDatabase_DeleteIfExistRegistrationOfUser(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	// two users subscribed the same endpoint, e.g. on a shared browser
+	for _, username := range []string{"alice", "stefan"} {
+		if err := db.AddBackendRegistration("webpush", username, "webpush-1", "https://push.example.org/abc", []string{"Inbox"}, nil); err != nil {
+			t.Fatal("Cannot add registration", err)
+		}
+	}
+	registrations, _ := db.FindRegistrations("alice", "Inbox")
+	var alice Registration
+	for _, registration := range registrations {
+		if registration.AccountId == "webpush-1" {
+			alice = registration
+		}
+	}
+	if alice.Username != "alice" {
+		t.Fatal("Registration without user", alice)
+	}
+	if _, ok := db.FindAccount("stefan", "webpush-1"); !ok {
+		t.Error("Account of stefan not found")
+	}
+
+	if !db.DeleteIfExistRegistration(alice) {
+		t.Error("Registration of alice could not be removed")
+	}
+	if _, ok := db.FindAccount("alice", "webpush-1"); ok {
+		t.Error("Registration of alice not removed")
+	}
+	if _, ok := db.FindAccount("stefan", "webpush-1"); !ok {
+		t.Error("Registration of stefan removed along with the one of alice")
+	}
+}
+
 func TestDatabase_CleanupRegistration(t *testing.T) {
 	DBCreateWorkingCopy()
 	db, err := NewDatabase("testdata/database_workingcpy.json")
@@ -209,3 +249,187 @@ func TestDatabase_CleanupRegistration(t *testing.T) {
 		t.Error("Registration not cleaned up!")
 	}
 }
+
+func TestDatabase_KeepUntilGone(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	if err := db.AddBackendRegistration("webpush", "alice", "webpush-1", "https://push.example.org/abc", []string{"Inbox"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	account := db.Users["alice"].Accounts["webpush-1"]
+	account.RegistrationTime = time.Now().Add(-time.Hour * 24 * 31)
+	db.Users["alice"].Accounts["webpush-1"] = account
+	db.KeepUntilGone("webpush")
+
+	if deleted := db.cleanupRegistered(); deleted != 1 {
+		t.Error("Expected 1 registration cleaned up, got", deleted)
+	}
+	arr, _ := db.FindRegistrations("alice", "Inbox")
+	if len(arr) != 1 || arr[0].AccountId != "webpush-1" {
+		t.Error("Web Push registration not kept:", arr)
+	}
+}
+
+func TestDatabase_SearchUsers(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	if len(db.SearchUsers("")) != 2 {
+		t.Error(`len(db.SearchUsers("")) != 2`)
+	}
+
+	users := db.SearchUsers("stefandevicetoken2")
+	if _, ok := users["stefan"]; !ok || len(users) != 1 {
+		t.Error(`db.SearchUsers("stefandevicetoken2") did not only return stefan`)
+	}
+
+	if len(db.SearchUsers("doesnotexist")) != 0 {
+		t.Error(`len(db.SearchUsers("doesnotexist")) != 0`)
+	}
+
+	// returned users must not share state with the database
+	users["stefan"].Accounts["stefanaccountid1"].Mailboxes[0] = "Changed"
+	registrations, _ := db.FindRegistrations("stefan", "Inbox")
+	if len(registrations) != 2 {
+		t.Error("Modifying a search result changed the database")
+	}
+}
+
+func TestDatabase_DeleteRegistration(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	if reg, ok := db.DeleteRegistration("stefan", "stefanaccountid1"); !ok || reg.DeviceToken != "stefandevicetoken1" {
+		t.Error("Account could not be removed")
+	}
+
+	if _, ok := db.DeleteRegistration("stefan", "stefanaccountid1"); ok {
+		t.Error("Not existent account has been *successfully* deleted???")
+	}
+
+	if len(db.FindRegistrationsByDeviceToken("stefandevicetoken1")) != 0 {
+		t.Error("Deleted account is still registered")
+	}
+
+	if _, ok := db.DeleteRegistration("alice", "aliceaccountid1"); !ok {
+		t.Error("Account could not be removed")
+	}
+
+	if db.UserExists("alice") {
+		t.Error("User without accounts has not been removed")
+	}
+}
+
+func TestDatabase_FindRegistrationsBatch(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	results := db.FindRegistrationsBatch([]Lookup{
+		{Username: "stefan", Mailbox: "Inbox"},
+		{Username: "stefan", Mailbox: "Cheese"},
+		{Username: "doesnotexist", Mailbox: "Inbox"},
+	})
+
+	if len(results) != 3 {
+		t.Fatal(`len(results) != 3`)
+	}
+
+	if len(results[0].Registrations) != 2 || !results[0].UserExists {
+		t.Error(`stefan/Inbox did not return 2 registrations`)
+	}
+
+	if len(results[1].Registrations) != 0 || !results[1].UserExists {
+		t.Error(`stefan/Cheese did not return an existing user without registrations`)
+	}
+
+	if len(results[2].Registrations) != 0 || results[2].UserExists {
+		t.Error(`doesnotexist/Inbox returned an existing user`)
+	}
+}
+
+func TestDatabase_DeleteUser(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	if len(db.DeleteUser("stefan")) != 2 {
+		t.Error(`len(db.DeleteUser("stefan")) != 2`)
+	}
+
+	if db.UserExists("stefan") {
+		t.Error("Deleted user still exists")
+	}
+
+	if len(db.DeleteUser("stefan")) != 0 {
+		t.Error("Not existent user has been *successfully* deleted???")
+	}
+}
+
+func TestDatabase_DeleteDeviceToken(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	registrations := db.DeleteDeviceToken("stefandevicetoken2")
+	if len(registrations) != 1 || registrations[0].AccountId != "stefanaccountid2" {
+		t.Error("Device token could not be removed")
+	}
+
+	if arr, _ := db.FindRegistrations("stefan", "Inbox"); len(arr) != 1 {
+		t.Error("Other accounts of the user have been removed")
+	}
+
+	if len(db.DeleteDeviceToken("stefandevicetoken2")) != 0 {
+		t.Error("Not existent device token has been *successfully* deleted???")
+	}
+}
+
+func TestDatabase_FindRegistrationsByPushKey(t *testing.T) {
+	DBCreateWorkingCopy()
+	db, err := NewDatabase("testdata/database_workingcpy.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database_workingcpy.json", err)
+	}
+
+	err = db.AddPushKeyRegistration("apns-calendar", "stefan", "stefancalendar", "stefandevicetoken3", []string{"calendar1", "calendar2"})
+	if err != nil {
+		t.Error("Cannot add push key registration", err)
+	}
+
+	registrations := db.FindRegistrationsByPushKey([]string{"calendar2", "unknown"})
+	if len(registrations) != 1 || registrations[0].PushKey != "calendar2" || registrations[0].Backend != "apns-calendar" {
+		t.Error("Unexpected registrations", registrations)
+	}
+
+	if arr, _ := db.FindRegistrations("stefan", "calendar1"); len(arr) != 0 {
+		t.Error("Push key matched as mailbox")
+	}
+
+	// the account ids of mail and push key registrations don't replace each other
+	if err := db.AddRegistration("stefan", "stefancalendar", "stefandevicetoken3", []string{"Inbox"}); !errors.Is(err, ErrBackendConflict) {
+		t.Error("Expected ErrBackendConflict for a mail registration, got", err)
+	}
+	if err := db.AddPushKeyRegistration("apns-contacts", "stefan", "stefanaccountid1", "stefandevicetoken1", []string{"contacts1"}); !errors.Is(err, ErrBackendConflict) {
+		t.Error("Expected ErrBackendConflict for a push key registration, got", err)
+	}
+	if len(db.FindRegistrationsByPushKey([]string{"calendar1"})) != 1 || len(db.FindRegistrationsByPushKey([]string{"contacts1"})) != 0 {
+		t.Error("Conflicting registration stored")
+	}
+}
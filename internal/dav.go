@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// PushKeyNotify is posted by CalDAV and CardDAV servers to /notify/pushkeys
+// when calendars or address books change
+type PushKeyNotify struct {
+	// push keys of the changed collections
+	PushKeys []string
+}
+
+// PushKeyNotifyResult is the body of a successful versioned push key notification
+type PushKeyNotifyResult struct {
+	Registrations int
+}
+
+// Handle a change of calendars or address books. Every device watching
+// one of the push keys is notified about the key by the notifier of its
+// subtopic.
+func (httpHandler *httpHandler) handleNotifyPushKeys(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
+	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
+
+	notify := PushKeyNotify{}
+	if err := json.NewDecoder(request.Body).Decode(&notify); err != nil {
+		logger.Errorf("Error while handling push key notify call: %s", err)
+		writeDecodeError(writer, request, err)
+		return
+	}
+	if violations := namesViolations("PushKeys", notify.PushKeys); len(violations) > 0 {
+		logViolations(logger, "push key notify", violations)
+		writeCodeViolations(writer, request, errorInvalidNotification, "invalid notification", violations)
+		return
+	}
+
+	registrations := httpHandler.db.FindRegistrationsByPushKey(notify.PushKeys)
+	if len(registrations) == 0 {
+		logger.Infoln("No registration found for push keys", notify.PushKeys)
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, registration := range registrations {
+		logger.Debugf("Found registration %s with token %s for push key: %s", registration.AccountId, registration.DeviceToken, registration.PushKey)
+		httpHandler.dispatcher.SendNotification(logger, registration, 0)
+	}
+	if isVersioned(request) {
+		writeJson(writer, http.StatusOK, PushKeyNotifyResult{Registrations: len(registrations)})
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
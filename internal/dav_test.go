@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sideshow/apns2"
+)
+
+func TestDav_PushKeys(t *testing.T) {
+	var path string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		path = request.URL.Path
+		body, _ = io.ReadAll(request.Body)
+	}))
+	defer server.Close()
+
+	dispatcher := newTestDispatcher(t)
+	calendar := &Apns{
+		Topic:    "com.apple.calendar.XServer.test",
+		subtopic: subtopicCalendar,
+		client:   &apns2.Client{Host: server.URL, HTTPClient: server.Client()},
+	}
+	dispatcher.Register(calendar)
+	usernames, err := username.NewCanonicalizer(&config.Config{})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer", err)
+	}
+	policy, err := newNotificationPolicy(config.NotificationPolicy{}, time.Second)
+	if err != nil {
+		t.Fatal("Cannot create policy", err)
+	}
+	handler := &httpHandler{db: dispatcher.db, apns: &Apns{Topic: "com.apple.mail.test"}, dispatcher: dispatcher, maxBodyBytes: 4096, policy: policy, usernames: usernames}
+	router := httprouter.New()
+	handler.registerRoutes(router, apiPrefix, versioned)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, apiPrefix+path, strings.NewReader(body)))
+		return recorder
+	}
+
+	reg := validRegister()
+	reg.ApsSubtopic, reg.Mailboxes, reg.PushKeys = subtopicCalendar, nil, []string{"key1", "key2"}
+	regJson, _ := json.Marshal(reg)
+	recorder := post("/register", string(regJson))
+	var response RegisterResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if recorder.Code != http.StatusOK || response.Topic != calendar.Topic {
+		t.Fatal("Unexpected response to calendar registration:", recorder.Code, recorder.Body)
+	}
+
+	reg.ApsSubtopic = subtopicContacts
+	regJson, _ = json.Marshal(reg)
+	if recorder := post("/register", string(regJson)); recorder.Code != http.StatusBadRequest {
+		t.Error("Registration of an unconfigured subtopic accepted:", recorder.Code)
+	}
+
+	// a mail registration doesn't replace the calendar registration of the same account id
+	mailJson, _ := json.Marshal(validRegister())
+	if recorder := post("/register", string(mailJson)); recorder.Code != http.StatusBadRequest {
+		t.Error("Mail registration of a calendar account accepted:", recorder.Code)
+	}
+
+	// mail notifications don't match push keys
+	if registrations, _ := dispatcher.db.FindRegistrations(reg.Username, "key1"); len(registrations) != 0 {
+		t.Error("Mailbox matched a push key:", registrations)
+	}
+
+	recorder = post("/notify/pushkeys", `{"PushKeys":["key2"]}`)
+	var result PushKeyNotifyResult
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	if recorder.Code != http.StatusOK || result.Registrations != 1 {
+		t.Fatal("Unexpected response to push key notification:", recorder.Code, recorder.Body)
+	}
+	if path != "/3/device/"+reg.ApsDeviceToken {
+		t.Error("Unexpected device path", path)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload["key"] != "key2" || payload["dataChangedTimestamp"] == nil {
+		t.Error("Unexpected payload", string(body), err)
+	}
+
+	if recorder := post("/notify/pushkeys", `{"PushKeys":["unknown"]}`); recorder.Code != http.StatusNoContent {
+		t.Error("Expected 204 for an unknown push key, got", recorder.Code)
+	}
+	if recorder := post("/notify/pushkeys", `{"PushKeys":[]}`); recorder.Code != http.StatusBadRequest {
+		t.Error("Expected 400 without push keys, got", recorder.Code)
+	}
+}
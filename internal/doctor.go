@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	roundtripUsername = "xapsd-doctor"
+	roundtripTopic    = "com.apple.mail.xapsd-doctor"
+	// time to wait for an immediate notification
+	roundtripTimeout = 5 * time.Second
+)
+
+// roundtripNotifier records the notifications of the roundtrip instead of
+// sending them to Apple
+type roundtripNotifier struct {
+	pushed chan database.Registration
+	pushRecorder
+}
+
+func (notifier *roundtripNotifier) Backend() string {
+	return backendApns
+}
+
+func (notifier *roundtripNotifier) Push(_ *log.Entry, registration database.Registration) (PushOutcome, error) {
+	notifier.pushed <- registration
+	return PushOutcome{Time: time.Now(), StatusCode: http.StatusOK}, nil
+}
+
+// Roundtrip registers a device via the HTTP API served on a loopback port
+// and notifies it about a new message in INBOX, like the Dovecot plugin
+// does. It uses the limits, the notification policy, the rate limits and
+// the username canonicalization of cfg, but a temporary database and a
+// notifier recording the push instead of APNs. It returns what happened
+// to the notification.
+func Roundtrip(cfg *config.Config) (string, error) {
+	dir, err := os.MkdirTemp("", "xapsd-doctor")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	db, err := database.NewDatabase(filepath.Join(dir, "database.json"))
+	if err != nil {
+		return "", fmt.Errorf("cannot create database: %w", err)
+	}
+	usernames, err := username.NewCanonicalizer(cfg)
+	if err != nil {
+		return "", fmt.Errorf("cannot setup username canonicalization: %w", err)
+	}
+	delay := time.Second * time.Duration(cfg.Delay)
+	policy, err := newNotificationPolicy(cfg.NotificationPolicy, delay)
+	if err != nil {
+		return "", fmt.Errorf("invalid notificationPolicy: %w", err)
+	}
+	notifier := &roundtripNotifier{pushed: make(chan database.Registration, 1)}
+	dispatcher := &Dispatcher{
+		db:        db,
+		notifiers: map[string]Notifier{backendApns: notifier},
+		queue:     make(map[database.Registration]queuedNotification),
+	}
+	dispatcher.retries, dispatcher.retryInterval = pushRetries(cfg)
+	limits := newHttpLimits(cfg)
+	handler := &httpHandler{db, &Apns{Topic: roundtripTopic, subtopic: subtopicMail}, dispatcher, limits.maxBodyBytes,
+		policy, usernames, newRateLimiter(cfg.RateLimits)}
+	router := httprouter.New()
+	handler.registerRoutes(router, apiPrefix, versioned)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	server := newHttpServer(limits, listener.Addr().String(), withRequestId(router))
+	go server.Serve(listener)
+	defer server.Close()
+	url := "http://" + listener.Addr().String() + apiPrefix
+
+	register := Register{
+		ApsAccountId:   roundtripUsername,
+		ApsDeviceToken: strings.Repeat("0", minDeviceTokenLength),
+		ApsSubtopic:    subtopicMail,
+		Username:       roundtripUsername,
+		Mailboxes:      []string{"INBOX"},
+	}
+	var registered RegisterResponse
+	if err := postJson(url+"/register", register, &registered); err != nil {
+		return "", fmt.Errorf("register: %w", err)
+	}
+	if registered.Topic != roundtripTopic {
+		return "", fmt.Errorf("register: unexpected topic %q", registered.Topic)
+	}
+
+	events := []string{"MessageNew"}
+	var result NotifyResult
+	if err := postJson(url+"/notify", Notify{Username: roundtripUsername, Mailbox: "INBOX", Events: events}, &result); err != nil {
+		return "", fmt.Errorf("notify: %w", err)
+	}
+	decision := policy.decide("INBOX", events)
+	switch {
+	case decision.action == actionIgnore:
+		return "", fmt.Errorf("the notificationPolicy ignores new messages in INBOX")
+	case result.Registrations != 1:
+		return "", fmt.Errorf("notify: found %d registrations instead of 1", result.Registrations)
+	case decision.action == actionDelayed:
+		return fmt.Sprintf("registered and notified, new messages are delayed by %s", decision.delay), nil
+	}
+	select {
+	case <-notifier.pushed:
+		return "registered, notified and pushed", nil
+	case <-time.After(roundtripTimeout):
+		return "", fmt.Errorf("notification has not been pushed within %s", roundtripTimeout)
+	}
+}
+
+// postJson posts request and decodes the JSON response of status 200 into response
+func postJson(url string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var apiError ErrorResponse
+		json.NewDecoder(res.Body).Decode(&apiError)
+		if len(apiError.Violations) > 0 {
+			return fmt.Errorf("returned %d %s %v", res.StatusCode, apiError.Message, apiError.Violations)
+		}
+		return fmt.Errorf("returned %d %s", res.StatusCode, apiError.Message)
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+func TestDoctor_Roundtrip(t *testing.T) {
+	if outcome, err := Roundtrip(&config.Config{}); err != nil || outcome != "registered, notified and pushed" {
+		t.Error("Roundtrip failed:", outcome, err)
+	}
+
+	cfg := config.Config{Delay: 30, NotificationPolicy: config.NotificationPolicy{
+		Events: map[string]config.EventPolicy{"messagenew": {Action: "delayed"}},
+	}}
+	if outcome, err := Roundtrip(&cfg); err != nil || !strings.Contains(outcome, "delayed by 30s") {
+		t.Error("Expected a delayed notification:", outcome, err)
+	}
+
+	cfg.NotificationPolicy.Events["messagenew"] = config.EventPolicy{Action: "ignore"}
+	if _, err := Roundtrip(&cfg); err == nil {
+		t.Error("Roundtrip succeeded although new messages are ignored")
+	}
+
+	cfg.UsernameDomainMode = "append"
+	if _, err := Roundtrip(&cfg); err == nil || !strings.Contains(err.Error(), "cannot setup username canonicalization") {
+		t.Error("Expected an error of the username canonicalization, got", err)
+	}
+}
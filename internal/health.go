@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultHealthCertExpiryDays = 7
+	defaultHealthMaxQueueSize   = 10000
+	// /readyz fails if APNs rejected the credentials of this many consecutive
+	// pushes within healthCredentialWindow
+	healthCredentialFailures = 3
+	healthCredentialWindow   = 10 * time.Minute
+
+	healthOk   = "ok"
+	healthFail = "fail"
+)
+
+type healthHandler struct {
+	db             *database.Database
+	apns           *Apns
+	dispatcher     *Dispatcher
+	certExpiryDays uint
+	maxQueueSize   uint
+}
+
+// HealthCheck is the result of a single readiness check
+type HealthCheck struct {
+	Status  string
+	Message string `json:",omitempty"`
+}
+
+// HealthReport is returned by /healthz and /readyz
+type HealthReport struct {
+	Status string
+	Checks map[string]HealthCheck `json:",omitempty"`
+}
+
+func newHealthHandler(cfg *config.Config, db *database.Database, apns *Apns, dispatcher *Dispatcher) *healthHandler {
+	health := &healthHandler{
+		db:             db,
+		apns:           apns,
+		dispatcher:     dispatcher,
+		certExpiryDays: cfg.HealthCertExpiryDays,
+		maxQueueSize:   cfg.HealthMaxQueueSize,
+	}
+	if health.certExpiryDays == 0 {
+		health.certExpiryDays = defaultHealthCertExpiryDays
+	}
+	if health.maxQueueSize == 0 {
+		health.maxQueueSize = defaultHealthMaxQueueSize
+	}
+	return health
+}
+
+func (health *healthHandler) registerRoutes(router *httprouter.Router, prefix string, wrap func(httprouter.Handle) httprouter.Handle) {
+	router.GET(prefix+"/healthz", wrap(health.handleHealthz))
+	router.GET(prefix+"/readyz", wrap(health.handleReadyz))
+}
+
+// handleHealthz answers as long as the process is able to serve requests
+func (health *healthHandler) handleHealthz(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writeJson(writer, http.StatusOK, HealthReport{Status: healthOk})
+}
+
+// handleReadyz checks whether notifications can be accepted and delivered
+func (health *healthHandler) handleReadyz(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	report := HealthReport{
+		Status: healthOk,
+		Checks: map[string]HealthCheck{
+			"database":    health.checkDatabase(),
+			"credentials": health.checkCredentials(health.apns),
+			"queue":       health.checkQueue(),
+		},
+	}
+	for _, notifier := range health.dispatcher.Notifiers() {
+		// the other backends push to endpoints chosen by the clients,
+		// their failures don't tell anything about xapsd
+		apns, ok := notifier.(*Apns)
+		if !ok {
+			continue
+		}
+		name := "lastPush"
+		if notifier.Backend() != backendApns {
+			name += "." + notifier.Backend()
+		}
+		report.Checks[name] = checkLastPush(apns)
+		// the certificates of the calendar and contacts subtopics
+		if apns != health.apns {
+			report.Checks["credentials."+notifier.Backend()] = health.checkCredentials(apns)
+		}
+	}
+	status := http.StatusOK
+	for _, check := range report.Checks {
+		if check.Status != healthOk {
+			report.Status = healthFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJson(writer, status, report)
+}
+
+func (health *healthHandler) checkDatabase() HealthCheck {
+	if health.db == nil {
+		return HealthCheck{healthFail, "database not loaded"}
+	}
+	if err := health.db.CheckWritable(); err != nil {
+		return HealthCheck{healthFail, "database not writable: " + err.Error()}
+	}
+	return HealthCheck{Status: healthOk}
+}
+
+func (health *healthHandler) checkCredentials(apns *Apns) HealthCheck {
+	expiry := apns.certificateExpiry()
+	if expiry.IsZero() {
+		return HealthCheck{healthOk, "token based authentication"}
+	}
+	remaining := time.Until(expiry)
+	if remaining <= 0 {
+		return HealthCheck{healthFail, fmt.Sprintf("certificate expired at %s", expiry)}
+	}
+	if remaining < time.Hour*24*time.Duration(health.certExpiryDays) {
+		return HealthCheck{healthFail, fmt.Sprintf("certificate expires at %s", expiry)}
+	}
+	return HealthCheck{healthOk, fmt.Sprintf("certificate valid until %s", expiry)}
+}
+
+// checkLastPush fails if APNs rejected the credentials repeatedly. Single
+// failures are specific to a device or temporary and only reported.
+func checkLastPush(apns *Apns) HealthCheck {
+	outcome := apns.LastPush()
+	if failures := apns.credentialFailuresSince(time.Now().Add(-healthCredentialWindow)); failures >= healthCredentialFailures {
+		return HealthCheck{healthFail, fmt.Sprintf("the last %d pushes within %s were rejected, last push at %s returned %d %s",
+			failures, healthCredentialWindow, outcome.Time, outcome.StatusCode, outcome.Reason)}
+	}
+	if outcome.Time.IsZero() {
+		return HealthCheck{healthOk, "no notification sent yet"}
+	}
+	if outcome.Error != "" {
+		return HealthCheck{healthOk, fmt.Sprintf("last push at %s failed: %s", outcome.Time, outcome.Error)}
+	}
+	message := fmt.Sprintf("last push at %s returned %d", outcome.Time, outcome.StatusCode)
+	if outcome.Reason != "" {
+		message += " " + outcome.Reason
+	}
+	return HealthCheck{healthOk, message}
+}
+
+func (health *healthHandler) checkQueue() HealthCheck {
+	size := health.dispatcher.QueueSize()
+	message := fmt.Sprintf("%d delayed notifications", size)
+	if uint(size) >= health.maxQueueSize {
+		return HealthCheck{healthFail, message}
+	}
+	return HealthCheck{healthOk, message}
+}
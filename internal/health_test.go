@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/julienschmidt/httprouter"
+)
+
+// readyz returns the status and the report of /readyz
+func readyz(t *testing.T, router *httprouter.Router) (int, HealthReport) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report HealthReport
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatal("Cannot decode health report", err)
+	}
+	return recorder.Code, report
+}
+
+func TestHealth_Readyz(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	apns := &Apns{Topic: "com.apple.mail.test", subtopic: subtopicMail}
+	webPush := &testNotifier{backend: backendWebPush}
+	dispatcher.Register(apns)
+	dispatcher.Register(webPush)
+	router := httprouter.New()
+	newHealthHandler(&config.Config{}, dispatcher.db, apns, dispatcher).registerRoutes(router, "", unversioned)
+
+	if status, report := readyz(t, router); status != http.StatusOK {
+		t.Fatal("Not ready without pushes", report)
+	}
+
+	// endpoints of Web Push and UnifiedPush are chosen by the clients
+	for range healthCredentialFailures {
+		webPush.record(backendWebPush, PushOutcome{StatusCode: http.StatusForbidden})
+		webPush.record(backendWebPush, PushOutcome{Error: "connection refused"})
+	}
+	// single rejections and server errors of APNs are not fatal
+	apns.record(backendApns, PushOutcome{StatusCode: http.StatusServiceUnavailable})
+	for range healthCredentialFailures - 1 {
+		apns.record(backendApns, PushOutcome{StatusCode: http.StatusForbidden, Reason: "InvalidProviderToken"})
+	}
+	if status, report := readyz(t, router); status != http.StatusOK {
+		t.Error("Not ready after single failures", report)
+	}
+
+	apns.record(backendApns, PushOutcome{StatusCode: http.StatusForbidden, Reason: "InvalidProviderToken"})
+	status, report := readyz(t, router)
+	if status != http.StatusServiceUnavailable || report.Checks["lastPush"].Status != healthFail {
+		t.Error("Ready after repeated credential failures", report)
+	}
+
+	// failures older than the window are forgotten
+	apns.pushRecorder.mutex.Lock()
+	for i := range apns.credentialFailures {
+		apns.credentialFailures[i] = apns.credentialFailures[i].Add(-healthCredentialWindow)
+	}
+	apns.pushRecorder.mutex.Unlock()
+	if status, report := readyz(t, router); status != http.StatusOK {
+		t.Error("Not ready after the failures expired", report)
+	}
+
+	// a successful push recovers at once
+	for range healthCredentialFailures {
+		apns.record(backendApns, PushOutcome{StatusCode: http.StatusForbidden, Reason: "ExpiredProviderToken"})
+	}
+	apns.record(backendApns, PushOutcome{StatusCode: http.StatusOK})
+	if status, report := readyz(t, router); status != http.StatusOK {
+		t.Error("Not ready after a successful push", report)
+	}
+}
@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	// maximum length of a single command line
+	maxLegacyLineLength = 64 << 10
+)
+
+// legacyCommand is a parsed line of the text protocol spoken by older
+// versions of the dovecot plugin. Every argument is stored as a list, a
+// quoted string is a list with a single element.
+type legacyCommand struct {
+	name string
+	args map[string][]string
+}
+
+// listenLegacySocket accepts connections on a unix socket speaking the text protocol:
+//
+//	REGISTER aps-account-id="AAA" aps-device-token="BBB" aps-subtopic="com.apple.mobilemail" dovecot-username="stefan" dovecot-mailboxes=("Inbox","Notes")
+//	OK com.apple.mail.XServer.xxxxxxxx
+//	NOTIFY dovecot-username="stefan" dovecot-mailbox="Inbox"
+//	OK
+//
+// Every command is answered with a line starting with OK or ERROR in the
+// order the commands were received, so clients may pipeline commands.
+// The connections are limited like the ones of the HTTP sockets.
+func listenLegacySocket(path, group string, limits httpLimits, httpHandler *httpHandler) error {
+	listener, err := newLegacyListener(path, group)
+	if err != nil {
+		return err
+	}
+	if limits.maxConnections > 0 {
+		listener = netutil.LimitListener(listener, limits.maxConnections)
+	}
+	log.Infoln("Listening for legacy commands on", path)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleLegacyConnection(conn, limits, httpHandler)
+	}
+}
+
+// newLegacyListener creates the socket at path, it is only accessible by
+// the owner and the group
+func newLegacyListener(path, group string) (net.Listener, error) {
+	// remove a stale socket from a previous run, but never anything else
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// lookupGroup returns the id of the group given by name or by id
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	found, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(found.Gid)
+}
+
+func handleLegacyConnection(conn net.Conn, limits httpLimits, httpHandler *httpHandler) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		// close connections idling or sending a line slowly
+		if limits.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(limits.idleTimeout))
+		}
+		line, err := readLegacyLine(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugln("Closing legacy connection:", err)
+			}
+			return
+		}
+		if line == "" {
+			continue
+		}
+		writer.WriteString(httpHandler.handleLegacyLine(line))
+		writer.WriteString("\n")
+		// flush once all pipelined commands are answered
+		if reader.Buffered() == 0 {
+			if limits.writeTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(limits.writeTimeout))
+			}
+			if err := writer.Flush(); err != nil {
+				log.Debugln("Closing legacy connection:", err)
+				return
+			}
+		}
+	}
+}
+
+// readLegacyLine returns the next line, a line cut off by a timeout is
+// discarded while the last line before EOF may lack the newline
+func readLegacyLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		line = append(line, fragment...)
+		if len(line) > maxLegacyLineLength {
+			return "", errors.New("line too long")
+		}
+		switch {
+		case err == nil:
+			return strings.TrimSpace(string(line)), nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(line) > 0:
+			return strings.TrimSpace(string(line)), nil
+		default:
+			return "", err
+		}
+	}
+}
+
+// handleLegacyLine executes a command and returns the response line
+func (httpHandler *httpHandler) handleLegacyLine(line string) string {
+	cmd, err := parseLegacyCommand(line)
+	if err != nil {
+		log.Errorf("Could not parse legacy command: %s", err)
+		return "ERROR " + err.Error()
+	}
+
+	// commands may carry the id of the IMAP session like the HTTP requests
+	id := cmd.arg("request-id")
+	if !validRequestId(id) {
+		id = newRequestId()
+	}
+	logger := newRequestLogger(id)
+
+	switch cmd.name {
+	case "REGISTER":
+		reg := Register{
+			ApsAccountId:   cmd.arg("aps-account-id"),
+			ApsDeviceToken: cmd.arg("aps-device-token"),
+			ApsSubtopic:    cmd.arg("aps-subtopic"),
+			Username:       cmd.arg("dovecot-username"),
+			Mailboxes:      cmd.args["dovecot-mailboxes"],
+		}
+		logger.Debugf("Received legacy Registration: %s", reg)
+		// the socket has no source address, so only the global and the per user limits apply
+		tokens, ok, retryAfter := httpHandler.limiter.allowRequest(endpointRegister, "")
+		if !ok {
+			logger.Warnf("Throttling legacy registration for %s", retryAfter)
+			return legacyError(http.StatusTooManyRequests)
+		}
+		result := httpHandler.register(logger, reg)
+		if result.status == http.StatusTooManyRequests {
+			tokens.cancel()
+		}
+		if result.status != http.StatusOK {
+			return legacyError(result.status)
+		}
+		return "OK " + result.topic
+	case "NOTIFY":
+		notify := Notify{
+			Username: cmd.arg("dovecot-username"),
+			Mailbox:  cmd.arg("dovecot-mailbox"),
+			Events:   cmd.args["events"],
+		}
+		// older plugins only notified about new messages
+		if len(notify.Events) == 0 {
+			notify.Events = []string{"MessageNew"}
+		}
+		tokens, ok, retryAfter := httpHandler.limiter.allowRequest(endpointNotify, "")
+		if !ok {
+			logger.Warnf("Throttling legacy notification for %s", retryAfter)
+			return legacyError(http.StatusTooManyRequests)
+		}
+		results := httpHandler.notify(logger, []Notify{notify})
+		if results[0].Status == http.StatusTooManyRequests {
+			tokens.cancel()
+		}
+		if results[0].Status >= http.StatusBadRequest && results[0].Status != http.StatusNotFound {
+			return legacyError(results[0].Status)
+		}
+		return "OK"
+	default:
+		logger.Errorf("Unknown legacy command: %s", cmd.name)
+		return "ERROR Unknown command " + cmd.name
+	}
+}
+
+func legacyError(status int) string {
+	return "ERROR " + http.StatusText(status)
+}
+
+// arg returns the first value of the named argument
+func (cmd *legacyCommand) arg(name string) string {
+	if values := cmd.args[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// parseLegacyCommand parses a line like
+//
+//	NAME key="value" key=("value1","value2") key=atom
+//
+// Quoted strings may contain backslash escaped quotes and backslashes.
+func parseLegacyCommand(line string) (*legacyCommand, error) {
+	name, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if name == "" {
+		return nil, errors.New("empty command")
+	}
+	cmd := &legacyCommand{name: strings.ToUpper(name), args: make(map[string][]string)}
+
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return cmd, nil
+		}
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t\"(),") {
+			return nil, fmt.Errorf("expected key=value at %q", rest)
+		}
+		var values []string
+		var err error
+		if strings.HasPrefix(value, "(") {
+			values, rest, err = parseLegacyList(value[1:])
+		} else {
+			var v string
+			v, rest, err = parseLegacyValue(value)
+			values = []string{v}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		cmd.args[key] = values
+	}
+}
+
+// parseLegacyList parses the remainder of a list after the opening parenthesis
+func parseLegacyList(input string) ([]string, string, error) {
+	values := []string{}
+	rest := strings.TrimLeft(input, " ")
+	if strings.HasPrefix(rest, ")") {
+		return values, rest[1:], nil
+	}
+	for {
+		value, remainder, err := parseLegacyValue(rest)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+		remainder = strings.TrimLeft(remainder, " ")
+		switch {
+		case strings.HasPrefix(remainder, ","):
+			rest = strings.TrimLeft(remainder[1:], " ")
+		case strings.HasPrefix(remainder, ")"):
+			return values, remainder[1:], nil
+		default:
+			return nil, "", errors.New("unterminated list")
+		}
+	}
+}
+
+// parseLegacyValue parses a quoted string or an atom and returns the remaining input
+func parseLegacyValue(input string) (string, string, error) {
+	if !strings.HasPrefix(input, `"`) {
+		end := strings.IndexAny(input, " \t,)")
+		if end == -1 {
+			end = len(input)
+		}
+		if end == 0 {
+			return "", "", errors.New("missing value")
+		}
+		return input[:end], input[end:], nil
+	}
+	var value strings.Builder
+	for i := 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+			if i == len(input) {
+				return "", "", errors.New("unterminated string")
+			}
+			value.WriteByte(input[i])
+		case '"':
+			return value.String(), input[i+1:], nil
+		default:
+			value.WriteByte(input[i])
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+)
+
+func TestLegacy_ParseCommand(t *testing.T) {
+	cmd, err := parseLegacyCommand(`REGISTER aps-account-id="AAA" aps-device-token="BBB" aps-subtopic="com.apple.mobilemail" dovecot-username="ste\"fan" dovecot-mailboxes=("Inbox", "Notes","Back\\slash")`)
+	if err != nil {
+		t.Fatal("Cannot parse REGISTER:", err)
+	}
+
+	if cmd.name != "REGISTER" {
+		t.Error(`cmd.name != "REGISTER"`)
+	}
+
+	if cmd.arg("aps-account-id") != "AAA" || cmd.arg("aps-device-token") != "BBB" {
+		t.Error("aps-account-id or aps-device-token not parsed")
+	}
+
+	if cmd.arg("dovecot-username") != `ste"fan` {
+		t.Error("Escaped quote not parsed:", cmd.arg("dovecot-username"))
+	}
+
+	if !reflect.DeepEqual(cmd.args["dovecot-mailboxes"], []string{"Inbox", "Notes", `Back\slash`}) {
+		t.Error("dovecot-mailboxes not parsed:", cmd.args["dovecot-mailboxes"])
+	}
+
+	cmd, err = parseLegacyCommand(`notify dovecot-username=stefan dovecot-mailbox="Inbox" events=()`)
+	if err != nil {
+		t.Fatal("Cannot parse NOTIFY:", err)
+	}
+
+	if cmd.name != "NOTIFY" || cmd.arg("dovecot-username") != "stefan" || len(cmd.args["events"]) != 0 {
+		t.Error("NOTIFY not parsed:", cmd)
+	}
+
+	for _, line := range []string{
+		``,
+		`NOTIFY dovecot-username="stefan`,
+		`NOTIFY dovecot-username`,
+		`NOTIFY dovecot-mailboxes=("Inbox"`,
+		`NOTIFY dovecot-mailboxes=("Inbox" "Notes")`,
+		`NOTIFY dovecot-username=`,
+	} {
+		if _, err := parseLegacyCommand(line); err == nil {
+			t.Errorf("Invalid line %q has been parsed", line)
+		}
+	}
+}
+
+func TestLegacy_Pipelining(t *testing.T) {
+	f, err := os.CreateTemp("", "legacy_test_database")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+
+	db, err := database.NewDatabase(f.Name())
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	policy, err := newNotificationPolicy(config.NotificationPolicy{}, time.Second)
+	if err != nil {
+		t.Fatal("Cannot create policy", err)
+	}
+	usernames, err := username.NewCanonicalizer(&config.Config{})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer", err)
+	}
+	handler := &httpHandler{db: db, apns: &Apns{Topic: "com.apple.mail.test"}, policy: policy, usernames: usernames}
+
+	server, client := net.Pipe()
+	go handleLegacyConnection(server, httpLimits{}, handler)
+	defer client.Close()
+
+	token := strings.Repeat("0123456789abcdef", 4)
+	go client.Write([]byte("REGISTER aps-account-id=\"AAA\" aps-device-token=\"" + token + "\" aps-subtopic=\"com.apple.mobilemail\" dovecot-username=\"Stefan\" dovecot-mailboxes=(\"Inbox\")\n" +
+		"NOTIFY dovecot-username=\"nobody\" dovecot-mailbox=\"INBOX\"\n" +
+		"REGISTER aps-account-id=\"AAA\"\n" +
+		"FOO\n"))
+
+	reader := bufio.NewReader(client)
+	for _, expected := range []string{
+		"OK com.apple.mail.test\n",
+		"OK\n",
+		"ERROR Bad Request\n",
+		"ERROR Unknown command FOO\n",
+	} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Cannot read response:", err)
+		}
+		if line != expected {
+			t.Errorf("Expected response %q, got %q", expected, line)
+		}
+	}
+
+	if !db.UserExists("stefan") {
+		t.Error("Registration has not been stored")
+	}
+}
+
+func TestLegacy_Listener(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "xapsd.sock")
+
+	// a stale socket of a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := newLegacyListener(path, strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Fatal("Stale socket not replaced:", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected mode 0660, got %s", info.Mode().Perm())
+	}
+
+	// anything else is kept
+	file := filepath.Join(dir, "database.json")
+	if err := os.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newLegacyListener(file, ""); err == nil {
+		t.Error("Regular file replaced by the socket")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "{}" {
+		t.Error("Regular file has been modified", err)
+	}
+}
+
+func TestLegacy_IdleTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	closed := make(chan struct{})
+	go func() {
+		handleLegacyConnection(server, httpLimits{idleTimeout: 50 * time.Millisecond}, &httpHandler{})
+		close(closed)
+	}()
+
+	// an incomplete line doesn't keep the connection open
+	go client.Write([]byte("NOTIFY dovecot-username="))
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Idle connection has not been closed")
+	}
+}
@@ -0,0 +1,108 @@
+// Package metrics contains the Prometheus collectors exported by xapsd.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "xapsd"
+
+var (
+	// RegisterRequests counts the /register requests by HTTP status
+	RegisterRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "register_requests_total",
+		Help:      "Register requests by HTTP status code.",
+	}, []string{"status"})
+
+	// NotifyRequests counts the /notify requests by HTTP status
+	NotifyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notify_requests_total",
+		Help:      "Notify requests by HTTP status code.",
+	}, []string{"status"})
+
+	// UnregisterRequests counts the requests to remove registrations by HTTP status
+	UnregisterRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unregister_requests_total",
+		Help:      "Unregister requests by HTTP status code.",
+	}, []string{"status"})
+
+	// Throttled counts the requests rejected by a rate limit by endpoint
+	// and limit (global, address or user)
+	Throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_requests_total",
+		Help:      "Requests rejected by a rate limit by endpoint and limit.",
+	}, []string{"endpoint", "limit"})
+
+	// Pushes counts the notifications sent by push backend, status and reason,
+	// status is "error" if the request to the push service failed. The reason
+	// is only set for APNs, other push services reply with free text.
+	Pushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pushes_total",
+		Help:      "Notifications sent by push backend, status code and reason.",
+	}, []string{"backend", "status", "reason"})
+
+	// PushRetries counts the notifications queued again after a temporary failure
+	PushRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_retries_total",
+		Help:      "Notifications queued again after a temporary failure by push backend.",
+	}, []string{"backend"})
+
+	// GoneDeletions counts the registrations deleted by push backend because
+	// the push service reported them as gone, e.g. 410 from APNS
+	GoneDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gone_deletions_total",
+		Help:      "Registrations deleted because the push service reported them as gone by push backend.",
+	}, []string{"backend"})
+
+	// DelayedQueueSize is the number of notifications waiting to be sent
+	DelayedQueueSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "delayed_queue_size",
+		Help:      "Number of delayed notifications waiting to be sent.",
+	})
+
+	// DelayLatency observes the time delayed notifications waited before being sent
+	DelayLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delay_latency_seconds",
+		Help:      "Time delayed notifications waited in the queue.",
+		Buckets:   []float64{5, 10, 20, 30, 45, 60, 90, 120, 300, 600},
+	})
+
+	// ApnsRequestDuration observes the duration of requests to APNS
+	ApnsRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "apns_request_duration_seconds",
+		Help:      "Duration of requests to APNS.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// RegisteredUsers is the number of users in the database
+	RegisteredUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registered_users",
+		Help:      "Number of users with at least one registered account.",
+	})
+
+	// RegisteredAccounts is the number of accounts in the database
+	RegisteredAccounts = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registered_accounts",
+		Help:      "Number of registered accounts.",
+	})
+
+	// CertificateExpiry is the expiry of the APNS certificate as unix timestamp
+	CertificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry of the APNS certificate, 0 for token based authentication.",
+	})
+)
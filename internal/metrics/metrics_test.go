@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestMetrics_Registry checks the names and labels of the exported metrics,
+// dashboards and alerts depend on them
+func TestMetrics_Registry(t *testing.T) {
+	RegisterRequests.WithLabelValues("200")
+	NotifyRequests.WithLabelValues("200")
+	UnregisterRequests.WithLabelValues("204")
+	Throttled.WithLabelValues("notify", "user")
+	Pushes.WithLabelValues("apns", "200", "")
+	PushRetries.WithLabelValues("apns")
+	GoneDeletions.WithLabelValues("apns")
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Cannot gather metrics", err)
+	}
+	labels := map[string][]string{}
+	for _, family := range families {
+		labels[family.GetName()] = labelNames(family)
+	}
+	for name, expected := range map[string][]string{
+		"xapsd_register_requests_total":              {"status"},
+		"xapsd_notify_requests_total":                {"status"},
+		"xapsd_unregister_requests_total":            {"status"},
+		"xapsd_throttled_requests_total":             {"endpoint", "limit"},
+		"xapsd_pushes_total":                         {"backend", "reason", "status"},
+		"xapsd_push_retries_total":                   {"backend"},
+		"xapsd_gone_deletions_total":                 {"backend"},
+		"xapsd_delayed_queue_size":                   nil,
+		"xapsd_delay_latency_seconds":                nil,
+		"xapsd_apns_request_duration_seconds":        nil,
+		"xapsd_registered_users":                     nil,
+		"xapsd_registered_accounts":                  nil,
+		"xapsd_certificate_expiry_timestamp_seconds": nil,
+	} {
+		actual, ok := labels[name]
+		if !ok {
+			t.Error("Metric not registered:", name)
+			continue
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected labels %v, got %v", name, expected, actual)
+		}
+	}
+}
+
+// labelNames returns the sorted label names of the first metric of family
+func labelNames(family *dto.MetricFamily) []string {
+	var names []string
+	for _, label := range family.GetMetric()[0].GetLabel() {
+		names = append(names, label.GetName())
+	}
+	sort.Strings(names)
+	return names
+}
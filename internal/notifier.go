@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPushRetries       = 3
+	defaultPushRetryInterval = 10
+)
+
+// errGone is returned by a Notifier if the registration is no longer valid
+var errGone = errors.New("registration is gone")
+
+// retryableError marks a temporary failure of a notification
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+// retryable marks err as a temporary failure worth another attempt
+func retryable(err error) error {
+	return retryableError{err}
+}
+
+// isRetryable returns whether the failure of a push is temporary
+func isRetryable(err error) bool {
+	var retryableError retryableError
+	return errors.As(err, &retryableError)
+}
+
+// statusError returns the error for an unsuccessful HTTP status of a push
+// service. Rate limits and server errors are retried.
+func statusError(status int, reason string) error {
+	err := fmt.Errorf("push service returned %d %s", status, reason)
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return fmt.Errorf("%w: %s", errGone, err)
+	case status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+		return retryable(err)
+	default:
+		return err
+	}
+}
+
+// Notifier delivers notifications via a push backend
+type Notifier interface {
+	// Backend returns the type stored in the registrations of the backend
+	Backend() string
+	// Push sends a notification to the registration without delay. It
+	// returns an error wrapping errGone if the registration is no longer
+	// valid and a retryable error for temporary failures.
+	Push(logger *log.Entry, registration database.Registration) (PushOutcome, error)
+	// LastPush returns the outcome of the last notification, its Time is
+	// zero if none was sent yet
+	LastPush() PushOutcome
+}
+
+// PushOutcome describes the result of a notification sent to a push service
+type PushOutcome struct {
+	Time       time.Time
+	StatusCode int    `json:",omitempty"`
+	Reason     string `json:",omitempty"`
+	// id assigned to the notification by the push service
+	Id    string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// Dispatcher is the registry of all notifiers. It delays, queues and
+// retries the notifications of all backends.
+type Dispatcher struct {
+	db            *database.Database
+	checkInterval uint
+	ticker        *time.Ticker
+	// retries and retryInterval are guarded by mapMutex
+	retries        uint
+	retryInterval  time.Duration
+	notifiersMutex sync.RWMutex
+	notifiers      map[string]Notifier
+	mapMutex       sync.Mutex
+	queue          map[database.Registration]queuedNotification
+	// keepGone keeps the registrations reported as gone in the database
+	keepGone bool
+}
+
+// queuedNotification is waiting in the queue until it is due
+type queuedNotification struct {
+	queued time.Time
+	due    time.Time
+	// number of failed attempts to send the notification
+	attempts uint
+	// logger of the request causing the notification
+	logger *log.Entry
+}
+
+func NewDispatcher(cfg *config.Config, db *database.Database) *Dispatcher {
+	dispatcher := &Dispatcher{
+		db:            db,
+		checkInterval: cfg.CheckInterval,
+		notifiers:     make(map[string]Notifier),
+		queue:         make(map[database.Registration]queuedNotification),
+	}
+	dispatcher.retries, dispatcher.retryInterval = pushRetries(cfg)
+	log.Debugln("Notifications for non NewMessage events will be delayed for", time.Second*time.Duration(cfg.Delay))
+	dispatcher.createDelayedNotificationThread()
+	return dispatcher
+}
+
+// pushRetries returns the attempts and the initial interval to retry
+// failed notifications
+func pushRetries(cfg *config.Config) (uint, time.Duration) {
+	retries := cfg.PushRetries
+	if retries == 0 {
+		retries = defaultPushRetries
+	}
+	retryInterval := time.Second * time.Duration(cfg.PushRetryInterval)
+	if retryInterval == 0 {
+		retryInterval = time.Second * defaultPushRetryInterval
+	}
+	return retries, retryInterval
+}
+
+// update applies the check interval and the retries of a reloaded config,
+// queued notifications are kept
+func (dispatcher *Dispatcher) update(cfg *config.Config) {
+	dispatcher.mapMutex.Lock()
+	dispatcher.retries, dispatcher.retryInterval = pushRetries(cfg)
+	dispatcher.mapMutex.Unlock()
+	if cfg.CheckInterval != dispatcher.checkInterval {
+		dispatcher.checkInterval = cfg.CheckInterval
+		dispatcher.ticker.Reset(time.Second * time.Duration(dispatcher.checkInterval))
+	}
+}
+
+// Register adds a notifier for the registrations of its backend
+func (dispatcher *Dispatcher) Register(notifier Notifier) {
+	dispatcher.notifiersMutex.Lock()
+	dispatcher.notifiers[notifier.Backend()] = notifier
+	dispatcher.notifiersMutex.Unlock()
+	log.Debugln("Registered notifier for backend", notifier.Backend())
+}
+
+// Notifier returns the notifier of the backend
+func (dispatcher *Dispatcher) Notifier(backend string) (Notifier, bool) {
+	dispatcher.notifiersMutex.RLock()
+	defer dispatcher.notifiersMutex.RUnlock()
+	notifier, ok := dispatcher.notifiers[backend]
+	return notifier, ok
+}
+
+// Notifiers returns all notifiers sorted by their backend
+func (dispatcher *Dispatcher) Notifiers() []Notifier {
+	dispatcher.notifiersMutex.RLock()
+	defer dispatcher.notifiersMutex.RUnlock()
+	notifiers := make([]Notifier, 0, len(dispatcher.notifiers))
+	for _, notifier := range dispatcher.notifiers {
+		notifiers = append(notifiers, notifier)
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return notifiers[i].Backend() < notifiers[j].Backend()
+	})
+	return notifiers
+}
+
+func (dispatcher *Dispatcher) createDelayedNotificationThread() {
+	dispatcher.ticker = time.NewTicker(time.Second * time.Duration(dispatcher.checkInterval))
+	go func() {
+		for range dispatcher.ticker.C {
+			dispatcher.checkDelayed()
+		}
+	}()
+}
+
+func (dispatcher *Dispatcher) checkDelayed() {
+	log.Debugln("Checking all delayed notifications")
+	sendNow := make(map[database.Registration]queuedNotification)
+	dispatcher.mapMutex.Lock()
+	for reg, queued := range dispatcher.queue {
+		queued.logger.Debugln("Registration", reg.AccountId, "/", reg.DeviceToken, "has been waiting for", time.Since(queued.queued))
+		if !time.Now().Before(queued.due) {
+			sendNow[reg] = queued
+			delete(dispatcher.queue, reg)
+			metrics.DelayLatency.Observe(time.Since(queued.queued).Seconds())
+		}
+	}
+	metrics.DelayedQueueSize.Set(float64(len(dispatcher.queue)))
+	dispatcher.mapMutex.Unlock()
+	for reg, queued := range sendNow {
+		dispatcher.send(queued.logger, reg, queued.attempts)
+	}
+}
+
+// SendNotification sends a notification to the registration after delay.
+// A pending delayed notification for the same registration is replaced,
+// or sent along if delay is zero.
+func (dispatcher *Dispatcher) SendNotification(logger *log.Entry, registration database.Registration, delay time.Duration) {
+	dispatcher.mapMutex.Lock()
+	if delay > 0 {
+		queued, ok := dispatcher.queue[registration]
+		if !ok {
+			queued.queued = time.Now()
+		} else if id := requestId(queued.logger); id != requestId(logger) {
+			logger.Debugln("Replacing delayed notification of request", id)
+		}
+		queued.due = time.Now().Add(delay)
+		queued.logger = logger
+		dispatcher.queue[registration] = queued
+		metrics.DelayedQueueSize.Set(float64(len(dispatcher.queue)))
+		dispatcher.mapMutex.Unlock()
+		logger.Debugln("Delaying notification to", registration.AccountId, "/", registration.DeviceToken, "for", delay)
+		return
+	}
+	if queued, ok := dispatcher.queue[registration]; ok && requestId(queued.logger) != requestId(logger) {
+		logger.Debugln("Sending delayed notification of request", requestId(queued.logger), "along")
+	}
+	delete(dispatcher.queue, registration)
+	metrics.DelayedQueueSize.Set(float64(len(dispatcher.queue)))
+	dispatcher.mapMutex.Unlock()
+	dispatcher.send(logger, registration, 0)
+}
+
+// send pushes the notification and queues it again on temporary failures
+func (dispatcher *Dispatcher) send(logger *log.Entry, registration database.Registration, attempts uint) {
+	_, err := dispatcher.Push(logger, registration)
+	if err == nil || !isRetryable(err) {
+		return
+	}
+	attempts++
+	dispatcher.mapMutex.Lock()
+	defer dispatcher.mapMutex.Unlock()
+	if attempts > dispatcher.retries {
+		logger.Errorln("Giving up notification to", registration.AccountId, "/", registration.DeviceToken, "after", attempts, "attempts:", err)
+		return
+	}
+	// back off exponentially
+	delay := dispatcher.retryInterval << (attempts - 1)
+	logger.Warnln("Retrying notification to", registration.AccountId, "/", registration.DeviceToken, "in", delay, ":", err)
+	metrics.PushRetries.WithLabelValues(registration.Backend).Inc()
+
+	if _, ok := dispatcher.queue[registration]; !ok {
+		dispatcher.queue[registration] = queuedNotification{
+			queued:   time.Now(),
+			due:      time.Now().Add(delay),
+			attempts: attempts,
+			logger:   logger,
+		}
+	}
+	metrics.DelayedQueueSize.Set(float64(len(dispatcher.queue)))
+}
+
+// Push sends a notification to the registration by the notifier of its
+// backend without delay. Registrations reported as gone are deleted.
+func (dispatcher *Dispatcher) Push(logger *log.Entry, registration database.Registration) (PushOutcome, error) {
+	notifier, ok := dispatcher.Notifier(registration.Backend)
+	if !ok {
+		err := fmt.Errorf("no notifier for backend %s", registration.Backend)
+		logger.Errorln("Cannot notify", registration.AccountId, "/", registration.DeviceToken, ":", err)
+		return PushOutcome{Time: time.Now(), Error: err.Error()}, err
+	}
+	outcome, err := notifier.Push(logger, registration)
+	if errors.Is(err, errGone) && dispatcher.keepGone {
+		logger.Warnln("Registration", registration.AccountId, "/", registration.DeviceToken, "is gone:", err)
+	} else if errors.Is(err, errGone) {
+		logger.Infoln("Deleting registration", registration.AccountId, "/", registration.DeviceToken, ":", err)
+		if dispatcher.db.DeleteIfExistRegistration(registration) {
+			metrics.GoneDeletions.WithLabelValues(registration.Backend).Inc()
+		}
+		dispatcher.Forget([]database.Registration{registration})
+	} else if err != nil {
+		logger.Errorln("Notification to", registration.AccountId, "/", registration.DeviceToken, "failed:", err)
+	}
+	return outcome, err
+}
+
+// Forget drops pending delayed notifications of the registrations,
+// including those about any push key of the registrations
+func (dispatcher *Dispatcher) Forget(registrations []database.Registration) {
+	forget := make(map[database.Registration]bool, len(registrations))
+	for _, registration := range registrations {
+		registration.PushKey = ""
+		forget[registration] = true
+	}
+	dispatcher.mapMutex.Lock()
+	for queued := range dispatcher.queue {
+		registration := queued
+		registration.PushKey = ""
+		if forget[registration] {
+			delete(dispatcher.queue, queued)
+		}
+	}
+	metrics.DelayedQueueSize.Set(float64(len(dispatcher.queue)))
+	dispatcher.mapMutex.Unlock()
+}
+
+// KeepGone makes Push keep registrations reported as gone. It is used by
+// commands running next to the daemon, which owns the database file.
+func (dispatcher *Dispatcher) KeepGone() {
+	dispatcher.keepGone = true
+}
+
+// QueueSize returns the number of delayed notifications
+func (dispatcher *Dispatcher) QueueSize() int {
+	dispatcher.mapMutex.Lock()
+	defer dispatcher.mapMutex.Unlock()
+	return len(dispatcher.queue)
+}
+
+// pushRecorder keeps the outcome of the last notification of a notifier
+type pushRecorder struct {
+	mutex    sync.Mutex
+	lastPush PushOutcome
+	// times of the consecutive pushes rejected with 403, at most
+	// healthCredentialFailures are kept
+	credentialFailures []time.Time
+}
+
+// record counts the outcome of a push, remembers and returns it. The reason
+// is used as label, it has to be one of a fixed set like the ones of APNs.
+func (recorder *pushRecorder) record(backend string, outcome PushOutcome) PushOutcome {
+	return recorder.recordLabeled(backend, outcome, outcome.Reason)
+}
+
+// recordStatus counts the outcome of a push service replying with free
+// text like the body of the response. Only the status code is used as
+// label, the reason is kept in the outcome.
+func (recorder *pushRecorder) recordStatus(backend string, outcome PushOutcome) PushOutcome {
+	return recorder.recordLabeled(backend, outcome, "")
+}
+
+func (recorder *pushRecorder) recordLabeled(backend string, outcome PushOutcome, reason string) PushOutcome {
+	outcome.Time = time.Now()
+	if outcome.StatusCode == 0 {
+		metrics.Pushes.WithLabelValues(backend, "error", "").Inc()
+	} else {
+		metrics.Pushes.WithLabelValues(backend, strconv.Itoa(outcome.StatusCode), reason).Inc()
+	}
+	recorder.mutex.Lock()
+	recorder.lastPush = outcome
+	switch {
+	case outcome.StatusCode == http.StatusForbidden:
+		recorder.credentialFailures = append(recorder.credentialFailures, outcome.Time)
+		if len(recorder.credentialFailures) > healthCredentialFailures {
+			recorder.credentialFailures = recorder.credentialFailures[1:]
+		}
+	case outcome.StatusCode != 0:
+		// any other answer of the push service accepted the credentials
+		recorder.credentialFailures = nil
+	}
+	recorder.mutex.Unlock()
+	return outcome
+}
+
+// credentialFailuresSince returns the number of consecutive pushes rejected
+// with 403 since the given time
+func (recorder *pushRecorder) credentialFailuresSince(since time.Time) int {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	count := 0
+	for _, failure := range recorder.credentialFailures {
+		if failure.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// LastPush returns the outcome of the last notification, its Time is zero if none was sent yet
+func (recorder *pushRecorder) LastPush() PushOutcome {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return recorder.lastPush
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// testNotifier fails with the queued errors and records all pushes
+type testNotifier struct {
+	backend string
+	errors  []error
+	pushed  []database.Registration
+	pushRecorder
+}
+
+func (notifier *testNotifier) Backend() string {
+	return notifier.backend
+}
+
+func (notifier *testNotifier) Push(_ *log.Entry, registration database.Registration) (PushOutcome, error) {
+	notifier.pushed = append(notifier.pushed, registration)
+	var err error
+	if len(notifier.errors) > 0 {
+		err, notifier.errors = notifier.errors[0], notifier.errors[1:]
+	}
+	return PushOutcome{Time: time.Now()}, err
+}
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	f, err := os.CreateTemp("", "notifier_test_database")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	db, err := database.NewDatabase(f.Name())
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	return &Dispatcher{
+		db:            db,
+		retries:       2,
+		retryInterval: time.Millisecond,
+		notifiers:     make(map[string]Notifier),
+		queue:         make(map[database.Registration]queuedNotification),
+	}
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	notifier := &testNotifier{backend: "test", errors: []error{
+		retryable(errors.New("timeout")),
+		retryable(errors.New("timeout")),
+		retryable(errors.New("timeout")),
+	}}
+	dispatcher.Register(notifier)
+	registration := database.Registration{DeviceToken: "token", AccountId: "account", Backend: "test"}
+	logger := newRequestLogger("test")
+
+	dispatcher.SendNotification(logger, registration, 0)
+	for attempt := 1; attempt <= 2; attempt++ {
+		if dispatcher.QueueSize() != 1 {
+			t.Fatalf("Failed notification not queued after attempt %d", attempt)
+		}
+		time.Sleep(time.Millisecond * 5)
+		dispatcher.checkDelayed()
+	}
+	if len(notifier.pushed) != 3 {
+		t.Errorf("Expected 3 attempts, got %d", len(notifier.pushed))
+	}
+	if dispatcher.QueueSize() != 0 {
+		t.Error("Notification still queued after the last retry")
+	}
+}
+
+func TestDispatcher_Gone(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	notifier := &testNotifier{backend: "test", errors: []error{statusError(410, "Unregistered")}}
+	dispatcher.Register(notifier)
+	if err := dispatcher.db.AddBackendRegistration("test", "stefan", "account", "token", []string{"INBOX"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	registrations, _ := dispatcher.db.FindRegistrations("stefan", "INBOX")
+	if len(registrations) != 1 || registrations[0].Backend != "test" {
+		t.Fatal("Registration of the backend not found:", registrations)
+	}
+
+	if _, err := dispatcher.Push(newRequestLogger("test"), registrations[0]); !errors.Is(err, errGone) {
+		t.Error("Expected errGone, got", err)
+	}
+	if dispatcher.db.UserExists("stefan") {
+		t.Error("Gone registration has not been deleted")
+	}
+
+	if _, err := dispatcher.Push(newRequestLogger("test"), database.Registration{Backend: "unknown"}); err == nil {
+		t.Error("Push to an unknown backend succeeded")
+	}
+}
+
+func TestDispatcher_KeepGone(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	dispatcher.KeepGone()
+	notifier := &testNotifier{backend: "test", errors: []error{statusError(410, "Unregistered")}}
+	dispatcher.Register(notifier)
+	if err := dispatcher.db.AddBackendRegistration("test", "stefan", "account", "token", []string{"INBOX"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	registrations, _ := dispatcher.db.FindRegistrations("stefan", "INBOX")
+
+	if _, err := dispatcher.Push(newRequestLogger("test"), registrations[0]); !errors.Is(err, errGone) {
+		t.Error("Expected errGone, got", err)
+	}
+	if !dispatcher.db.UserExists("stefan") {
+		t.Error("Gone registration has been deleted")
+	}
+}
+
+func TestDispatcher_Delay(t *testing.T) {
+	dispatcher := newTestDispatcher(t)
+	notifier := &testNotifier{backend: "test"}
+	dispatcher.Register(notifier)
+	registration := database.Registration{DeviceToken: "token", AccountId: "account", Backend: "test"}
+
+	dispatcher.SendNotification(newRequestLogger("first"), registration, time.Hour)
+	dispatcher.SendNotification(newRequestLogger("second"), registration, time.Hour)
+	if dispatcher.QueueSize() != 1 || len(notifier.pushed) != 0 {
+		t.Fatal("Delayed notifications not merged")
+	}
+	dispatcher.SendNotification(newRequestLogger("third"), registration, 0)
+	if dispatcher.QueueSize() != 0 || len(notifier.pushed) != 1 {
+		t.Error("Delayed notification not sent along")
+	}
+}
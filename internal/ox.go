@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// OxNotify is posted by the "ox" driver of the Dovecot push_notification
+// plugin. It is enabled in Dovecot like:
+//
+//	plugin {
+//	  push_notification_driver = ox:url=http://[::1]:11619/ox
+//	}
+//
+// The driver only notifies users having the metadata key
+// /private/vendor/vendor.dovecot/http-notify set to "user=<username>".
+// From, subject and snippet are only present if enabled in Dovecot and
+// never forwarded to Apple.
+type OxNotify struct {
+	User            string `json:"user"`
+	Folder          string `json:"folder"`
+	Event           string `json:"event"`
+	Unseen          int    `json:"unseen"`
+	ImapUidValidity uint32 `json:"imap-uidvalidity"`
+	ImapUid         uint32 `json:"imap-uid"`
+	From            string `json:"from"`
+	Subject         string `json:"subject"`
+	Snippet         string `json:"snippet"`
+}
+
+// Handle a notification of the Dovecot ox driver by mapping it onto a
+// Notify and processing it like a request to /notify.
+func (httpHandler *httpHandler) handleOxNotify(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
+	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
+
+	oxNotify := OxNotify{}
+	err := json.NewDecoder(request.Body).Decode(&oxNotify)
+	if err != nil {
+		logger.Errorf("Error while handling ox notify call: %s", err)
+		writeDecodeError(writer, request, err)
+		return
+	}
+
+	logger.Debugf("Received ox notification for %s in %s: %s", oxNotify.User, oxNotify.Folder, oxNotify.Event)
+
+	results := httpHandler.notify(logger, []Notify{oxNotify.toNotify()})
+	writeNotifyResult(writer, request, results[0])
+}
+
+// toNotify converts the notification, the ox driver names events in
+// lower camel case ("messageNew") while the xaps plugin uses the Dovecot
+// event names ("MessageNew").
+func (oxNotify *OxNotify) toNotify() Notify {
+	notify := Notify{
+		Username: oxNotify.User,
+		Mailbox:  oxNotify.Folder,
+	}
+	if oxNotify.Event != "" {
+		notify.Events = []string{strings.ToUpper(oxNotify.Event[:1]) + oxNotify.Event[1:]}
+	}
+	return notify
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestOx_ToNotify(t *testing.T) {
+	for _, test := range []struct {
+		oxNotify OxNotify
+		notify   Notify
+	}{
+		{
+			OxNotify{User: "stefan", Folder: "INBOX", Event: "messageNew", Unseen: 3, ImapUid: 42, Subject: "never forwarded"},
+			Notify{Username: "stefan", Mailbox: "INBOX", Events: []string{"MessageNew"}},
+		},
+		{
+			OxNotify{User: "stefan@example.org", Folder: "Archive/2024", Event: "messageAppend"},
+			Notify{Username: "stefan@example.org", Mailbox: "Archive/2024", Events: []string{"MessageAppend"}},
+		},
+		{
+			OxNotify{User: "stefan", Folder: "INBOX", Event: "MessageNew"},
+			Notify{Username: "stefan", Mailbox: "INBOX", Events: []string{"MessageNew"}},
+		},
+		{
+			OxNotify{User: "stefan", Folder: "INBOX", Event: "m"},
+			Notify{Username: "stefan", Mailbox: "INBOX", Events: []string{"M"}},
+		},
+		// rejected by checkParams
+		{
+			OxNotify{User: "stefan", Folder: "INBOX"},
+			Notify{Username: "stefan", Mailbox: "INBOX"},
+		},
+		{
+			OxNotify{Folder: "INBOX", Event: "messageNew"},
+			Notify{Mailbox: "INBOX", Events: []string{"MessageNew"}},
+		},
+	} {
+		if notify := test.oxNotify.toNotify(); !reflect.DeepEqual(notify, test.notify) {
+			t.Errorf("%+v: expected %+v, got %+v", test.oxNotify, test.notify, notify)
+		}
+	}
+}
+
+func TestOx_Handle(t *testing.T) {
+	router := newApiTestRouter(t)
+
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"user":"nobody","folder":"INBOX","event":"messageNew","unseen":1,"imap-uidvalidity":1,"imap-uid":2}`, http.StatusNotFound},
+		{`{"user":"nobody","folder":"INBOX"}`, http.StatusBadRequest},
+		{`{"user":"","folder":"INBOX","event":"messageNew"}`, http.StatusBadRequest},
+	} {
+		if recorder := serve(router, http.MethodPost, "/ox", test.body); recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.body, test.status, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+const (
+	actionImmediate = "immediate"
+	actionDelayed   = "delayed"
+	actionIgnore    = "ignore"
+)
+
+// eventAction is the resolved handling of an event, delay is only set for delayed events
+type eventAction struct {
+	action string
+	delay  time.Duration
+}
+
+type mailboxPolicy struct {
+	defaultAction *eventAction
+	events        map[string]eventAction
+}
+
+// notificationPolicy decides whether the events of a notification are
+// pushed immediately, delayed or ignored. Lookups fall back from the
+// mailbox specific event to the mailbox default, the global event and the
+// global default. Mailboxes other than INBOX are ignored unless they are
+// configured explicitly.
+type notificationPolicy struct {
+	// mutex guards the actions replaced by update
+	mutex         sync.RWMutex
+	defaultAction eventAction
+	events        map[string]eventAction
+	mailboxes     map[string]mailboxPolicy
+}
+
+// newNotificationPolicy creates the policy from the config. Without any
+// configuration new messages are pushed immediately and all other events
+// in INBOX are delayed by delay.
+func newNotificationPolicy(cfg config.NotificationPolicy, delay time.Duration) (*notificationPolicy, error) {
+	policy := &notificationPolicy{
+		defaultAction: eventAction{actionDelayed, delay},
+		events: map[string]eventAction{
+			"messagenew": {action: actionImmediate},
+		},
+		mailboxes: make(map[string]mailboxPolicy),
+	}
+	if cfg.Default.Action != "" {
+		action, err := newEventAction(cfg.Default, delay)
+		if err != nil {
+			return nil, fmt.Errorf("default: %w", err)
+		}
+		policy.defaultAction = action
+	}
+	for event, eventPolicy := range cfg.Events {
+		action, err := newEventAction(eventPolicy, delay)
+		if err != nil {
+			return nil, fmt.Errorf("event %s: %w", event, err)
+		}
+		policy.events[strings.ToLower(event)] = action
+	}
+	for mailbox, cfgMailbox := range cfg.Mailboxes {
+		mailboxPolicy := mailboxPolicy{events: make(map[string]eventAction)}
+		if cfgMailbox.Default.Action != "" {
+			action, err := newEventAction(cfgMailbox.Default, delay)
+			if err != nil {
+				return nil, fmt.Errorf("mailbox %s default: %w", mailbox, err)
+			}
+			mailboxPolicy.defaultAction = &action
+		}
+		for event, eventPolicy := range cfgMailbox.Events {
+			action, err := newEventAction(eventPolicy, delay)
+			if err != nil {
+				return nil, fmt.Errorf("mailbox %s event %s: %w", mailbox, event, err)
+			}
+			mailboxPolicy.events[strings.ToLower(event)] = action
+		}
+		policy.mailboxes[strings.ToLower(mailbox)] = mailboxPolicy
+	}
+	return policy, nil
+}
+
+func newEventAction(eventPolicy config.EventPolicy, delay time.Duration) (eventAction, error) {
+	switch strings.ToLower(eventPolicy.Action) {
+	case actionImmediate:
+		return eventAction{action: actionImmediate}, nil
+	case actionDelayed:
+		if eventPolicy.Delay > 0 {
+			delay = time.Second * time.Duration(eventPolicy.Delay)
+		}
+		return eventAction{actionDelayed, delay}, nil
+	case actionIgnore:
+		return eventAction{action: actionIgnore}, nil
+	default:
+		return eventAction{}, fmt.Errorf("unknown action %q, expected %s, %s or %s", eventPolicy.Action, actionImmediate, actionDelayed, actionIgnore)
+	}
+}
+
+// update replaces the actions by the ones of reloaded
+func (policy *notificationPolicy) update(reloaded *notificationPolicy) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	policy.defaultAction, policy.events, policy.mailboxes = reloaded.defaultAction, reloaded.events, reloaded.mailboxes
+}
+
+// decide returns the most urgent action of all events in the mailbox
+func (policy *notificationPolicy) decide(mailbox string, events []string) eventAction {
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	decision := eventAction{action: actionIgnore}
+	for _, event := range events {
+		decision = moreUrgent(decision, policy.lookup(mailbox, event))
+	}
+	return decision
+}
+
+func (policy *notificationPolicy) lookup(mailbox, event string) eventAction {
+	event = strings.ToLower(event)
+	mailboxPolicy, ok := policy.mailboxes[strings.ToLower(mailbox)]
+	if !ok {
+		if mailbox != "INBOX" {
+			return eventAction{action: actionIgnore}
+		}
+	} else {
+		if action, ok := mailboxPolicy.events[event]; ok {
+			return action
+		}
+		if mailboxPolicy.defaultAction != nil {
+			return *mailboxPolicy.defaultAction
+		}
+	}
+	if action, ok := policy.events[event]; ok {
+		return action
+	}
+	return policy.defaultAction
+}
+
+// moreUrgent returns the action leading to the earlier push
+func moreUrgent(a, b eventAction) eventAction {
+	switch {
+	case a.action == actionImmediate || b.action == actionIgnore:
+		return a
+	case b.action == actionImmediate || a.action == actionIgnore:
+		return b
+	case b.delay < a.delay:
+		return b
+	default:
+		return a
+	}
+}
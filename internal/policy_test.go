@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+func TestPolicy_Decide(t *testing.T) {
+	policy, err := newNotificationPolicy(config.NotificationPolicy{
+		Events: map[string]config.EventPolicy{
+			"messageappend": {Action: "delayed", Delay: 60},
+			"flagsset":      {Action: "ignore"},
+		},
+		Mailboxes: map[string]config.MailboxPolicy{
+			"sent": {
+				Events: map[string]config.EventPolicy{"messageappend": {Action: "ignore"}},
+			},
+			"notes": {
+				Default: config.EventPolicy{Action: "immediate"},
+			},
+		},
+	}, 30*time.Second)
+	if err != nil {
+		t.Fatal("Cannot create policy:", err)
+	}
+
+	for _, test := range []struct {
+		mailbox  string
+		events   []string
+		expected eventAction
+	}{
+		{"INBOX", []string{"MessageNew"}, eventAction{action: actionImmediate}},
+		{"INBOX", []string{"MessageExpunge"}, eventAction{actionDelayed, 30 * time.Second}},
+		{"INBOX", []string{"MessageAppend"}, eventAction{actionDelayed, 60 * time.Second}},
+		{"INBOX", []string{"MessageAppend", "MessageExpunge"}, eventAction{actionDelayed, 30 * time.Second}},
+		{"INBOX", []string{"FlagsSet"}, eventAction{action: actionIgnore}},
+		{"INBOX", []string{"FlagsSet", "MessageNew"}, eventAction{action: actionImmediate}},
+		{"Sent", []string{"MessageAppend"}, eventAction{action: actionIgnore}},
+		{"Sent", []string{"MessageNew"}, eventAction{action: actionImmediate}},
+		{"Notes", []string{"FlagsSet"}, eventAction{action: actionImmediate}},
+		{"Spam", []string{"MessageNew"}, eventAction{action: actionIgnore}},
+	} {
+		if decision := policy.decide(test.mailbox, test.events); decision != test.expected {
+			t.Errorf("decide(%s, %v) = %v, expected %v", test.mailbox, test.events, decision, test.expected)
+		}
+	}
+
+	_, err = newNotificationPolicy(config.NotificationPolicy{
+		Events: map[string]config.EventPolicy{"messagenew": {Action: "later"}},
+	}, time.Second)
+	if err == nil {
+		t.Error("Unknown action has been accepted")
+	}
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
+)
+
+const (
+	endpointRegister = "register"
+	endpointNotify   = "notify"
+
+	limitGlobal  = "global"
+	limitAddress = "address"
+	limitUser    = "user"
+
+	// interval to drop the buckets of idle clients
+	rateLimitCleanupInterval = 5 * time.Minute
+)
+
+// rateLimiter holds the token buckets of all endpoints
+type rateLimiter struct {
+	// mutex guards the endpoints replaced by update
+	mutex     sync.RWMutex
+	endpoints map[string]*endpointLimiter
+}
+
+type endpointLimiter struct {
+	global     *rate.Limiter
+	perAddress *keyedLimiter
+	perUser    *keyedLimiter
+}
+
+// keyedLimiter creates a token bucket for each key on demand
+type keyedLimiter struct {
+	limit   rate.Limit
+	burst   int
+	mutex   sync.Mutex
+	buckets map[string]*rate.Limiter
+}
+
+func newRateLimiter(cfg config.RateLimits) *rateLimiter {
+	limiter := &rateLimiter{endpoints: newEndpointLimiters(cfg)}
+	limiter.createCleanupThread()
+	return limiter
+}
+
+func newEndpointLimiters(cfg config.RateLimits) map[string]*endpointLimiter {
+	return map[string]*endpointLimiter{
+		endpointRegister: newEndpointLimiter(cfg.Register),
+		endpointNotify:   newEndpointLimiter(cfg.Notify),
+	}
+}
+
+// update replaces the limits by the ones of a reloaded config. The buckets
+// start full again.
+func (limiter *rateLimiter) update(cfg config.RateLimits) {
+	endpoints := newEndpointLimiters(cfg)
+	limiter.mutex.Lock()
+	limiter.endpoints = endpoints
+	limiter.mutex.Unlock()
+}
+
+// endpoint returns the buckets of the endpoint
+func (limiter *rateLimiter) endpoint(endpoint string) *endpointLimiter {
+	limiter.mutex.RLock()
+	defer limiter.mutex.RUnlock()
+	return limiter.endpoints[endpoint]
+}
+
+func newEndpointLimiter(cfg config.EndpointRateLimits) *endpointLimiter {
+	endpoint := &endpointLimiter{
+		perAddress: newKeyedLimiter(cfg.PerAddress),
+		perUser:    newKeyedLimiter(cfg.PerUser),
+	}
+	if cfg.Global.Rate > 0 {
+		limit, burst := rateLimit(cfg.Global)
+		endpoint.global = rate.NewLimiter(limit, burst)
+	}
+	return endpoint
+}
+
+func newKeyedLimiter(cfg config.RateLimit) *keyedLimiter {
+	if cfg.Rate == 0 {
+		return nil
+	}
+	limit, burst := rateLimit(cfg)
+	return &keyedLimiter{limit: limit, burst: burst, buckets: make(map[string]*rate.Limiter)}
+}
+
+// rateLimit converts the configured rate per minute, the burst defaults to the rate
+func rateLimit(cfg config.RateLimit) (rate.Limit, int) {
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = cfg.Rate
+	}
+	return rate.Limit(float64(cfg.Rate) / 60), int(burst)
+}
+
+// requestTokens are the tokens taken for a request, they are given back if
+// the request is rejected by the per user limit later on
+type requestTokens struct {
+	at           time.Time
+	reservations []*rate.Reservation
+}
+
+// cancel gives the tokens back to their buckets
+func (tokens *requestTokens) cancel() {
+	if tokens == nil {
+		return
+	}
+	for _, reservation := range tokens.reservations {
+		reservation.CancelAt(tokens.at)
+	}
+}
+
+// allowRequest takes a token of the bucket of the source address and of
+// the global bucket of the endpoint. An empty address is not limited.
+// The address is checked first, so a throttled client can't exhaust the
+// global bucket. If a bucket is empty the tokens already taken are given
+// back and the time to wait is returned.
+func (limiter *rateLimiter) allowRequest(endpoint, address string) (*requestTokens, bool, time.Duration) {
+	if limiter == nil {
+		return nil, true, 0
+	}
+	endpointLimiter := limiter.endpoint(endpoint)
+	tokens := &requestTokens{at: time.Now()}
+	if address != "" {
+		reservation := endpointLimiter.perAddress.reserve(address, tokens.at)
+		if delay := throttle(reservation, tokens.at); delay > 0 {
+			metrics.Throttled.WithLabelValues(endpoint, limitAddress).Inc()
+			return nil, false, delay
+		}
+		if reservation != nil {
+			tokens.reservations = append(tokens.reservations, reservation)
+		}
+	}
+	if endpointLimiter.global != nil {
+		reservation := endpointLimiter.global.ReserveN(tokens.at, 1)
+		if delay := throttle(reservation, tokens.at); delay > 0 {
+			tokens.cancel()
+			metrics.Throttled.WithLabelValues(endpoint, limitGlobal).Inc()
+			return nil, false, delay
+		}
+		tokens.reservations = append(tokens.reservations, reservation)
+	}
+	return tokens, true, 0
+}
+
+// allowUser takes a token of the bucket of the username of the endpoint
+func (limiter *rateLimiter) allowUser(endpoint, username string) (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+	now := time.Now()
+	if delay := throttle(limiter.endpoint(endpoint).perUser.reserve(username, now), now); delay > 0 {
+		metrics.Throttled.WithLabelValues(endpoint, limitUser).Inc()
+		return false, delay
+	}
+	return true, 0
+}
+
+// throttle returns the time to wait for the reservation made at now and
+// cancels it if the request has to wait. A nil reservation is never
+// throttled.
+func throttle(reservation *rate.Reservation, now time.Time) time.Duration {
+	if reservation == nil {
+		return 0
+	}
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// reserve returns a reservation of the bucket of key at now or nil if there is no limit
+func (keyed *keyedLimiter) reserve(key string, now time.Time) *rate.Reservation {
+	if keyed == nil {
+		return nil
+	}
+	keyed.mutex.Lock()
+	defer keyed.mutex.Unlock()
+	bucket, ok := keyed.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(keyed.limit, keyed.burst)
+		keyed.buckets[key] = bucket
+	}
+	return bucket.ReserveN(now, 1)
+}
+
+// cleanup drops all full buckets, they behave like newly created ones
+func (keyed *keyedLimiter) cleanup() {
+	if keyed == nil {
+		return
+	}
+	keyed.mutex.Lock()
+	defer keyed.mutex.Unlock()
+	for key, bucket := range keyed.buckets {
+		if bucket.Tokens() >= float64(keyed.burst) {
+			delete(keyed.buckets, key)
+		}
+	}
+}
+
+func (limiter *rateLimiter) createCleanupThread() {
+	cleanupTicker := time.NewTicker(rateLimitCleanupInterval)
+	go func() {
+		for range cleanupTicker.C {
+			for _, endpoint := range []string{endpointRegister, endpointNotify} {
+				endpointLimiter := limiter.endpoint(endpoint)
+				endpointLimiter.perAddress.cleanup()
+				endpointLimiter.perUser.cleanup()
+			}
+		}
+	}()
+}
+
+// throttled returns a wrapper rejecting requests exceeding the global or
+// the per address limit of the endpoint with 429
+func (httpHandler *httpHandler) throttled(endpoint string, handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		address, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			address = request.RemoteAddr
+		}
+		tokens, ok, retryAfter := httpHandler.limiter.allowRequest(endpoint, address)
+		if !ok {
+			requestLogger(request).Warnf("Throttling %s request of %s for %s", endpoint, address, retryAfter)
+			tooManyRequests(writer, request, retryAfter)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		handle(recorder, request, params)
+		// the request has been rejected by the per user limit
+		if recorder.status == http.StatusTooManyRequests {
+			tokens.cancel()
+		}
+	}
+}
+
+// tooManyRequests replies 429 with the seconds to wait in the Retry-After header
+func tooManyRequests(writer http.ResponseWriter, request *http.Request, retryAfter time.Duration) {
+	seconds := strconv.Itoa(retryAfterSeconds(retryAfter))
+	writer.Header().Set("Retry-After", seconds)
+	writeError(writer, request, http.StatusTooManyRequests, errorRateLimited, "retry after "+seconds+" seconds")
+}
+
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Max(1, math.Ceil(retryAfter.Seconds())))
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRateLimit_Request(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimits{
+		Register: config.EndpointRateLimits{
+			Global:     config.RateLimit{Rate: 1, Burst: 2},
+			PerAddress: config.RateLimit{Rate: 1},
+		},
+	})
+
+	if _, ok, _ := limiter.allowRequest(endpointRegister, "192.0.2.1"); !ok {
+		t.Error("First request has been throttled")
+	}
+	_, ok, retryAfter := limiter.allowRequest(endpointRegister, "192.0.2.1")
+	if ok {
+		t.Error("Second request of the address has not been throttled")
+	}
+	if retryAfter <= 0 {
+		t.Error("Missing retry after:", retryAfter)
+	}
+	// the rejected request must not have taken the global token
+	if _, ok, _ := limiter.allowRequest(endpointRegister, "192.0.2.2"); !ok {
+		t.Error("Request of another address has been throttled")
+	}
+	if _, ok, _ := limiter.allowRequest(endpointRegister, "192.0.2.3"); ok {
+		t.Error("Global limit has not been applied")
+	}
+	if _, ok, _ := limiter.allowRequest(endpointNotify, "192.0.2.1"); !ok {
+		t.Error("Notify has been throttled without limits")
+	}
+
+	var nilLimiter *rateLimiter
+	if _, ok, _ := nilLimiter.allowRequest(endpointNotify, "192.0.2.1"); !ok {
+		t.Error("Missing limiter throttled the request")
+	}
+}
+
+func TestRateLimit_GiveBack(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimits{
+		Register: config.EndpointRateLimits{
+			Global:     config.RateLimit{Rate: 1},
+			PerAddress: config.RateLimit{Rate: 1},
+		},
+	})
+
+	if _, ok, _ := limiter.allowRequest(endpointRegister, "192.0.2.1"); !ok {
+		t.Error("First request has been throttled")
+	}
+	if _, ok, _ := limiter.allowRequest(endpointRegister, "192.0.2.2"); ok {
+		t.Error("Global limit has not been applied")
+	}
+	// the request rejected by the global bucket gave back the token of its address
+	if tokens := limiter.endpoint(endpointRegister).perAddress.buckets["192.0.2.2"].Tokens(); tokens < 0.99 {
+		t.Error("Token of the address has not been given back, left", tokens)
+	}
+
+	// a request rejected by the per user limit gives back all tokens
+	handler := &httpHandler{limiter: newRateLimiter(config.RateLimits{
+		Register: config.EndpointRateLimits{
+			Global:     config.RateLimit{Rate: 1},
+			PerAddress: config.RateLimit{Rate: 1},
+		},
+	})}
+	status := http.StatusTooManyRequests
+	handle := handler.throttled(endpointRegister, func(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		writer.WriteHeader(status)
+	})
+	for _, expected := range []int{http.StatusTooManyRequests, http.StatusOK, http.StatusTooManyRequests} {
+		recorder := httptest.NewRecorder()
+		handle(recorder, httptest.NewRequest(http.MethodPost, "/register", nil), nil)
+		if recorder.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, recorder.Code)
+		}
+		status = http.StatusOK
+	}
+}
+
+func TestRateLimit_User(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimits{
+		Notify: config.EndpointRateLimits{
+			PerUser: config.RateLimit{Rate: 60, Burst: 1},
+		},
+	})
+
+	if ok, _ := limiter.allowUser(endpointNotify, "stefan"); !ok {
+		t.Error("First notification has been throttled")
+	}
+	if ok, _ := limiter.allowUser(endpointNotify, "stefan"); ok {
+		t.Error("Second notification has not been throttled")
+	}
+	if ok, _ := limiter.allowUser(endpointNotify, "other"); !ok {
+		t.Error("Notification of another user has been throttled")
+	}
+	if ok, _ := limiter.allowUser(endpointRegister, "stefan"); !ok {
+		t.Error("Register has been throttled without limits")
+	}
+}
+
+func TestRateLimit_RetryAfter(t *testing.T) {
+	handler := &httpHandler{limiter: newRateLimiter(config.RateLimits{
+		Register: config.EndpointRateLimits{PerAddress: config.RateLimit{Rate: 1}},
+	})}
+	handle := handler.throttled(endpointRegister, func(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		writer.WriteHeader(http.StatusOK)
+	})
+
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		request := httptest.NewRequest(http.MethodPost, "/register", nil)
+		recorder := httptest.NewRecorder()
+		handle(recorder, request, nil)
+		if recorder.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, recorder.Code)
+		}
+		if expected == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") != "60" {
+			t.Errorf("Expected Retry-After 60, got %q", recorder.Header().Get("Retry-After"))
+		}
+	}
+}
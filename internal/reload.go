@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	reloadOk   = "ok"
+	reloadFail = "fail"
+)
+
+// liveOptions are applied by a reload without a restart, options ending
+// with a dot include all options below them
+var liveOptions = []string{
+	"logLevel",
+	"checkInterval",
+	"delay",
+	"pushRetries",
+	"pushRetryInterval",
+	"notificationPolicy.",
+	"rateLimits.",
+	"certificateFileP12",
+	"certificateFilePem",
+	"certificateFilePemKey",
+	"keyFileP8",
+	"keyFileTopic",
+	"keyFileKeyId",
+	"keyFileTeamId",
+	"calendarPush.",
+	"contactsPush.",
+}
+
+// subtopicOptions are the options of the certificates of the subtopics,
+// enabling or disabling a subtopic requires a restart
+var subtopicOptions = map[string]string{
+	subtopicCalendar: "calendarPush",
+	subtopicContacts: "contactsPush",
+}
+
+// ReloadStatus is the outcome of the last reload of the configuration
+type ReloadStatus struct {
+	// zero if the configuration has not been reloaded yet
+	Time   time.Time
+	Status string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	// options applied by the last reload
+	Applied []string `json:",omitempty"`
+	// options changed since the start which are not applied until a restart
+	RestartRequired []string `json:",omitempty"`
+}
+
+// Reloader applies the safe changes of a reloaded configuration to the
+// running daemon: the log level, the delays and retries of the dispatcher,
+// the notification policy, the rate limits and the APNs credentials.
+type Reloader struct {
+	mutex sync.Mutex
+	load  func() (config.Config, error)
+	// the configuration at the start and the last one applied
+	started    config.Config
+	current    config.Config
+	dispatcher *Dispatcher
+	apns       *Apns
+	policy     *notificationPolicy
+	limiter    *rateLimiter
+	status     ReloadStatus
+}
+
+// NewReloader creates a reloader of the configuration cfg returned by load.
+// The credentials are not reloaded if apns is nil.
+func NewReloader(cfg *config.Config, load func() (config.Config, error), dispatcher *Dispatcher, apns *Apns) *Reloader {
+	return &Reloader{
+		load:       load,
+		started:    *cfg,
+		current:    *cfg,
+		dispatcher: dispatcher,
+		apns:       apns,
+	}
+}
+
+// attach adds the policy and the rate limits of the HTTP socket
+func (reloader *Reloader) attach(policy *notificationPolicy, limiter *rateLimiter) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.policy, reloader.limiter = policy, limiter
+}
+
+// Status returns the outcome of the last reload
+func (reloader *Reloader) Status() ReloadStatus {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.status
+}
+
+// Reload loads the configuration and applies the safe changes. Changes
+// requiring a restart are logged. The running configuration is kept if
+// the new one is invalid.
+func (reloader *Reloader) Reload() ReloadStatus {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	log.Infoln("Reloading configuration")
+	status := ReloadStatus{Time: time.Now(), Status: reloadOk}
+	cfg, err := reloader.load()
+	if err == nil {
+		err = reloader.apply(&cfg)
+	}
+	if err != nil {
+		log.Errorln("Keeping the running configuration, reload failed:", err)
+		status.Status, status.Error = reloadFail, err.Error()
+		status.RestartRequired = reloader.status.RestartRequired
+		reloader.status = status
+		return status
+	}
+
+	for _, option := range config.Changes(reloader.current, cfg) {
+		if isLiveOption(option) {
+			status.Applied = append(status.Applied, option)
+		}
+	}
+	for _, option := range config.Changes(reloader.started, cfg) {
+		if !isLiveOption(option) {
+			status.RestartRequired = append(status.RestartRequired, option)
+		}
+	}
+	status.RestartRequired = append(status.RestartRequired, reloader.toggledSubtopics(&cfg)...)
+	reloader.current = cfg
+	reloader.status = status
+
+	if len(status.Applied) > 0 {
+		log.Infoln("Applied changed options", strings.Join(status.Applied, ", "))
+	} else {
+		log.Infoln("No changed options to apply")
+	}
+	if len(status.RestartRequired) > 0 {
+		log.Warnln("Changed options require a restart:", strings.Join(status.RestartRequired, ", "))
+	}
+	return status
+}
+
+// apply prepares all changes first, so nothing is applied if any of them
+// fails, e.g. because of a missing certificate
+func (reloader *Reloader) apply(cfg *config.Config) error {
+	level, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	policy, err := newNotificationPolicy(cfg.NotificationPolicy, time.Second*time.Duration(cfg.Delay))
+	if err != nil {
+		return err
+	}
+	var apns *Apns
+	var subtopicApns []*Apns
+	if reloader.apns != nil {
+		if apns, err = newApns(cfg); err != nil {
+			return err
+		}
+		if subtopicApns, err = NewSubtopicApns(cfg); err != nil {
+			return err
+		}
+	}
+
+	log.SetLevel(level)
+	reloader.dispatcher.update(cfg)
+	if reloader.policy != nil {
+		reloader.policy.update(policy)
+	}
+	if reloader.limiter != nil && changed(config.Changes(reloader.current, *cfg), "rateLimits.") {
+		reloader.limiter.update(cfg.RateLimits)
+	}
+	if apns != nil {
+		reloader.apns.update(apns)
+	}
+	for _, reloaded := range subtopicApns {
+		// enabled subtopics are only registered at the start
+		if notifier, ok := reloader.dispatcher.Notifier(reloaded.Backend()); ok {
+			if running, ok := notifier.(*Apns); ok {
+				running.update(reloaded)
+			}
+		}
+	}
+	return nil
+}
+
+// toggledSubtopics returns the options of subtopics enabled or disabled
+// by cfg, their notifiers are only registered at the start
+func (reloader *Reloader) toggledSubtopics(cfg *config.Config) []string {
+	var options []string
+	certificates := subtopicCertificates(cfg)
+	for subtopic, option := range subtopicOptions {
+		_, running := reloader.dispatcher.Notifier(subtopicBackends[subtopic])
+		if _, enabled := certificates[subtopic]; running != enabled {
+			options = append(options, option)
+		}
+	}
+	sort.Strings(options)
+	return options
+}
+
+func isLiveOption(option string) bool {
+	for _, live := range liveOptions {
+		if option == live || strings.HasSuffix(live, ".") && strings.HasPrefix(option, live) {
+			return true
+		}
+	}
+	return false
+}
+
+// changed returns whether any of the options is below prefix
+func changed(options []string, prefix string) bool {
+	for _, option := range options {
+		if strings.HasPrefix(option, prefix) {
+			return true
+		}
+	}
+	return false
+}
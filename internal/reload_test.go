@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestReloader_Reload(t *testing.T) {
+	started := config.Config{LogLevel: "info", Port: "11619", CheckInterval: 20, Delay: 30}
+	dispatcher := newTestDispatcher(t)
+	dispatcher.checkInterval = started.CheckInterval
+	dispatcher.ticker = time.NewTicker(time.Hour)
+	t.Cleanup(dispatcher.ticker.Stop)
+	policy, _ := newNotificationPolicy(started.NotificationPolicy, 30*time.Second)
+	limiter := newRateLimiter(started.RateLimits)
+	t.Cleanup(func() { log.SetLevel(log.InfoLevel) })
+
+	reloaded := started
+	var loadErr error
+	reloader := NewReloader(&started, func() (config.Config, error) { return reloaded, loadErr }, dispatcher, nil)
+	reloader.attach(policy, limiter)
+	if status := reloader.Status(); !status.Time.IsZero() {
+		t.Error("Unexpected status before the first reload", status)
+	}
+
+	reloaded.LogLevel, reloaded.CheckInterval, reloaded.Delay, reloaded.PushRetries = "debug", 5, 60, 5
+	reloaded.RateLimits.Notify.PerUser = config.RateLimit{Rate: 1}
+	reloaded.Port = "11620"
+	status := reloader.Reload()
+	if status.Status != reloadOk {
+		t.Fatal("Reload failed:", status.Error)
+	}
+	expected := []string{"logLevel", "checkInterval", "delay", "pushRetries", "rateLimits.notify.perUser.rate"}
+	if !reflect.DeepEqual(status.Applied, expected) {
+		t.Errorf("Expected applied options %v, got %v", expected, status.Applied)
+	}
+	if !reflect.DeepEqual(status.RestartRequired, []string{"port"}) {
+		t.Error("Expected port to require a restart, got", status.RestartRequired)
+	}
+	if log.GetLevel() != log.DebugLevel || dispatcher.checkInterval != 5 || dispatcher.retries != 5 {
+		t.Error("Changes have not been applied", log.GetLevel(), dispatcher.checkInterval, dispatcher.retries)
+	}
+	if decision := policy.decide("INBOX", []string{"FlagsSet"}); decision.delay != 60*time.Second {
+		t.Error("Delay of the policy has not been updated", decision)
+	}
+	limiter.allowUser(endpointNotify, "stefan")
+	if ok, _ := limiter.allowUser(endpointNotify, "stefan"); ok {
+		t.Error("Rate limit has not been updated")
+	}
+
+	// an invalid config keeps the running one
+	loadErr = errors.New("checkInterval: must be at least 1 second")
+	status = reloader.Reload()
+	if status.Status != reloadFail || status.Error != loadErr.Error() || reloader.Status().Status != reloadFail {
+		t.Error("Failed reload not reported", status)
+	}
+	if !reflect.DeepEqual(status.RestartRequired, []string{"port"}) || dispatcher.checkInterval != 5 {
+		t.Error("Running configuration has been changed by a failed reload", status)
+	}
+
+	// reverting the port needs no restart
+	loadErr, reloaded.Port = nil, started.Port
+	if status = reloader.Reload(); status.Status != reloadOk || len(status.Applied) != 0 || len(status.RestartRequired) != 0 {
+		t.Error("Unexpected status after reverting the port", status)
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// header carrying the id of a request, it is echoed in every response
+	requestIdHeader = "X-Request-Id"
+	// the dovecot plugin may send the id of the IMAP session instead
+	sessionIdHeader = "X-Session-Id"
+
+	maxRequestIdLength = 128
+)
+
+type requestLoggerKey struct{}
+
+// withRequestId adds a logger carrying the request id to the context of every request
+func withRequestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = request.Header.Get(sessionIdHeader)
+		}
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		writer.Header().Set(requestIdHeader, id)
+		ctx := context.WithValue(request.Context(), requestLoggerKey{}, newRequestLogger(id))
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// requestLogger returns the logger of the request
+func requestLogger(request *http.Request) *log.Entry {
+	if logger, ok := request.Context().Value(requestLoggerKey{}).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// requestId returns the id attached to the logger or an empty string
+func requestId(logger *log.Entry) string {
+	id, _ := logger.Data["request_id"].(string)
+	return id
+}
+
+func newRequestLogger(id string) *log.Entry {
+	return log.WithField("request_id", id)
+}
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalln("Could not generate request id:", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// validRequestId only accepts ids consisting of printable ASCII to keep the logs clean
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
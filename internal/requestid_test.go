@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestId_Header(t *testing.T) {
+	var id string
+	handler := withRequestId(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		id = requestId(requestLogger(request))
+	}))
+
+	for _, test := range []struct {
+		header, value string
+		keep          bool
+	}{
+		{requestIdHeader, "abc-123", true},
+		{sessionIdHeader, "imap-session", true},
+		{requestIdHeader, "with space", false},
+		{requestIdHeader, strings.Repeat("a", maxRequestIdLength+1), false},
+		{"", "", false},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/notify", nil)
+		if test.header != "" {
+			request.Header.Set(test.header, test.value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if echoed := recorder.Header().Get(requestIdHeader); echoed != id {
+			t.Errorf("Echoed id %q differs from logged id %q", echoed, id)
+		}
+		if test.keep && id != test.value {
+			t.Errorf("Expected id %q, got %q", test.value, id)
+		}
+		if !test.keep && (id == test.value || !validRequestId(id)) {
+			t.Errorf("Expected a generated id for %q, got %q", test.value, id)
+		}
+	}
+}
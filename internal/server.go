@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	defaultHttpReadHeaderTimeout = 10 * time.Second
+	defaultHttpReadTimeout       = 30 * time.Second
+	defaultHttpWriteTimeout      = 30 * time.Second
+	defaultHttpIdleTimeout       = 5 * time.Minute
+	defaultHttpMaxHeaderBytes    = 16 << 10
+	defaultHttpMaxBodyBytes      = 64 << 10
+)
+
+type connRequestsKey struct{}
+
+// httpLimits holds the limits applied to the HTTP servers of xapsd
+type httpLimits struct {
+	readHeaderTimeout        time.Duration
+	readTimeout              time.Duration
+	writeTimeout             time.Duration
+	idleTimeout              time.Duration
+	maxHeaderBytes           int
+	maxBodyBytes             int64
+	maxConnections           int
+	maxRequestsPerConnection uint64
+}
+
+func newHttpLimits(cfg *config.Config) httpLimits {
+	limits := httpLimits{
+		readHeaderTimeout:        secondsOrDefault(cfg.HttpReadHeaderTimeout, defaultHttpReadHeaderTimeout),
+		readTimeout:              secondsOrDefault(cfg.HttpReadTimeout, defaultHttpReadTimeout),
+		writeTimeout:             secondsOrDefault(cfg.HttpWriteTimeout, defaultHttpWriteTimeout),
+		idleTimeout:              secondsOrDefault(cfg.HttpIdleTimeout, defaultHttpIdleTimeout),
+		maxHeaderBytes:           int(cfg.HttpMaxHeaderBytes),
+		maxBodyBytes:             int64(cfg.HttpMaxBodyBytes),
+		maxConnections:           int(cfg.HttpMaxConnections),
+		maxRequestsPerConnection: uint64(cfg.HttpMaxRequestsPerConnection),
+	}
+	if limits.maxHeaderBytes == 0 {
+		limits.maxHeaderBytes = defaultHttpMaxHeaderBytes
+	}
+	if limits.maxBodyBytes == 0 {
+		limits.maxBodyBytes = defaultHttpMaxBodyBytes
+	}
+	return limits
+}
+
+func secondsOrDefault(seconds uint, def time.Duration) time.Duration {
+	if seconds == 0 {
+		return def
+	}
+	return time.Second * time.Duration(seconds)
+}
+
+// newHttpServer creates a server for handler honouring the configured limits
+func newHttpServer(limits httpLimits, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: limits.readHeaderTimeout,
+		ReadTimeout:       limits.readTimeout,
+		WriteTimeout:      limits.writeTimeout,
+		IdleTimeout:       limits.idleTimeout,
+		MaxHeaderBytes:    limits.maxHeaderBytes,
+	}
+	if limits.maxRequestsPerConnection > 0 {
+		server.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, connRequestsKey{}, new(atomic.Uint64))
+		}
+		server.Handler = limitRequestsPerConnection(limits.maxRequestsPerConnection, handler)
+	}
+	return server
+}
+
+// limitRequestsPerConnection closes a keep-alive connection after it served max requests
+func limitRequestsPerConnection(max uint64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if requests, ok := request.Context().Value(connRequestsKey{}).(*atomic.Uint64); ok {
+			if requests.Add(1) >= max {
+				writer.Header().Set("Connection", "close")
+			}
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// listenAndServe accepts connections for server up to the configured connection limit,
+// the server is started with TLS if it has a TLSConfig
+func listenAndServe(server *http.Server, limits httpLimits) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	if limits.maxConnections > 0 {
+		log.Debugln("Limiting connections on", server.Addr, "to", limits.maxConnections)
+		listener = netutil.LimitListener(listener, limits.maxConnections)
+	}
+	if server.TLSConfig != nil {
+		// certificate and key are provided by the TLSConfig
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// limitBody caps the size of the request body
+func limitBody(writer http.ResponseWriter, request *http.Request, maxBytes int64) {
+	request.Body = http.MaxBytesReader(writer, request.Body, maxBytes)
+}
+
+// decodeStatus returns the status to reply with if reading the body failed
+func decodeStatus(err error) int {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
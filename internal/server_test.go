@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+// serveLimited serves a handler reading the request body with the limits of cfg
+func serveLimited(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	limits := newHttpLimits(cfg)
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		limitBody(writer, request, limits.maxBodyBytes)
+		if _, err := io.ReadAll(request.Body); err != nil {
+			writer.WriteHeader(decodeStatus(err))
+		}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newHttpServer(limits, listener.Addr().String(), handler)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func TestServer_BodyLimit(t *testing.T) {
+	addr := serveLimited(t, &config.Config{HttpMaxBodyBytes: 16})
+
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{strings.Repeat("a", 16), http.StatusOK},
+		{strings.Repeat("a", 17), http.StatusRequestEntityTooLarge},
+	} {
+		res, err := http.Post("http://"+addr+"/notify", "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal("Request failed", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("Body of %d bytes: expected %d, got %d", len(test.body), test.status, res.StatusCode)
+		}
+	}
+}
+
+func TestServer_HeaderTimeout(t *testing.T) {
+	addr := serveLimited(t, &config.Config{HttpReadHeaderTimeout: 1})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a slow client never finishing its headers
+	if _, err := conn.Write([]byte("POST /notify HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	// the server closes the connection, possibly after replying 408
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Error("Connection not closed after the header timeout, waited", elapsed)
+	}
+}
+
+func TestServer_RequestsPerConnection(t *testing.T) {
+	addr := serveLimited(t, &config.Config{HttpMaxRequestsPerConnection: 2})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i, closing := range []bool{false, true} {
+		if _, err := conn.Write([]byte("GET /healthz HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Request %d failed: %s", i+1, err)
+		}
+		res.Body.Close()
+		if res.Close != closing {
+			t.Errorf("Request %d: expected close %t, got %t", i+1, closing, res.Close)
+		}
+	}
+	// the server closed the connection after the second request
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Error("Connection still open after the limit, got", err)
+	}
+}
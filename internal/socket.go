@@ -2,18 +2,29 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/freswa/dovecot-xaps-daemon/internal/config"
 	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
 type httpHandler struct {
-	db   *database.Database
-	apns *Apns
+	db           *database.Database
+	apns         *Apns
+	dispatcher   *Dispatcher
+	maxBodyBytes int64
+	policy       *notificationPolicy
+	usernames    *username.Canonicalizer
+	limiter      *rateLimiter
 }
 
 // Register struct to handle register requests via IMAP like:
@@ -22,12 +33,16 @@ type httpHandler struct {
 //		aps-subtopic="com.apple.mobilemail"
 //		dovecot-username="stefan"
 //		dovecot-mailboxes=("Inbox","Notes")
+//
+// Registrations of the calendar and contacts subtopics contain the push
+// keys of the watched collections instead of mailboxes.
 type Register struct {
 	ApsAccountId   string
 	ApsDeviceToken string
 	ApsSubtopic    string
 	Username       string
 	Mailboxes      []string
+	PushKeys       []string `json:",omitempty"`
 }
 
 // NOTIFY dovecot-username="stefan" dovecot-mailbox="Inbox"
@@ -37,25 +52,81 @@ type Notify struct {
 	Events   []string
 }
 
-func NewHttpSocket(config *config.Config, db *database.Database, apns *Apns) {
+// NotifyResult is returned for each item of a batch notify request,
+// Status is the HTTP status the item would have received from /notify.
+// RetryAfter is the number of seconds to wait if the item was throttled.
+type NotifyResult struct {
+	Username      string
+	Mailbox       string
+	Status        int
+	Registrations int
+	RetryAfter    int `json:",omitempty"`
+}
+
+// NewHttpSocket serves the API, the policy and the rate limits are updated by reloader
+func NewHttpSocket(config *config.Config, db *database.Database, apns *Apns, dispatcher *Dispatcher, usernames *username.Canonicalizer, reloader *Reloader) {
 	router := httprouter.New()
-	httpSocket := httpHandler{db, apns}
-	router.POST("/register", httpSocket.handleRegister)
-	router.POST("/notify", httpSocket.handleNotify)
+	limits := newHttpLimits(config)
+	policy, err := newNotificationPolicy(config.NotificationPolicy, time.Second*time.Duration(config.Delay))
+	if err != nil {
+		log.Fatalln("Invalid notificationPolicy:", err)
+	}
+	httpSocket := httpHandler{db, apns, dispatcher, limits.maxBodyBytes, policy, usernames, newRateLimiter(config.RateLimits)}
+	reloader.attach(httpSocket.policy, httpSocket.limiter)
+	health := newHealthHandler(config, db, apns, dispatcher)
+	// the unversioned routes are kept for existing plugins
+	httpSocket.registerRoutes(router, "", unversioned)
+	health.registerRoutes(router, "", unversioned)
+	httpSocket.registerRoutes(router, apiPrefix, versioned)
+	health.registerRoutes(router, apiPrefix, versioned)
+	router.GET(apiPrefix+"/openapi.json", handleOpenApi)
+	router.NotFound = apiFallback(http.StatusNotFound, errorNotFound)
+	router.MethodNotAllowed = apiFallback(http.StatusMethodNotAllowed, errorMethodNotAllowed)
+	router.Handler(http.MethodGet, "/metrics", promhttp.Handler())
+	if config.LegacySocket != "" {
+		go func() {
+			err := listenLegacySocket(config.LegacySocket, config.LegacySocketGroup, limits, &httpSocket)
+			if err != nil {
+				log.Fatalf("Could not listen on legacy socket %s: %s", config.LegacySocket, err)
+			}
+		}()
+	}
 	if len(config.TlsCertfile) > 0 || len(config.TlsKeyfile) > 0 {
+		tlsConfig, err := newTlsConfig(config)
+		if err != nil {
+			log.Fatalln("Could not setup TLS:", err)
+		}
+		tlsServer := newHttpServer(limits, config.TlsListenAddr+":"+config.TlsPort, withRequestId(router))
+		tlsServer.TLSConfig = tlsConfig
 		go func() {
-			err := http.ListenAndServeTLS(config.TlsListenAddr+":"+config.TlsPort, config.TlsCertfile, config.TlsKeyfile, router)
+			err := listenAndServe(tlsServer, limits)
 			if err != nil {
 				log.Fatalf("Could not listen on address %s:%s: %s", config.TlsListenAddr, config.TlsPort, err)
 			}
 		}()
 	}
-	err := http.ListenAndServe(config.ListenAddr+":"+config.Port, router)
+	server := newHttpServer(limits, config.ListenAddr+":"+config.Port, withRequestId(router))
+	err = listenAndServe(server, limits)
 	if err != nil {
 		log.Fatalf("Could not listen on address %s:%s: %s", config.ListenAddr, config.Port, err)
 	}
 }
 
+// registerRoutes adds the routes to register and notify below prefix
+func (httpHandler *httpHandler) registerRoutes(router *httprouter.Router, prefix string, wrap func(httprouter.Handle) httprouter.Handle) {
+	router.POST(prefix+"/register", wrap(instrumented(metrics.RegisterRequests)(httpHandler.throttled(endpointRegister, httpHandler.handleRegister))))
+	router.POST(prefix+"/notify", wrap(instrumented(metrics.NotifyRequests)(httpHandler.throttled(endpointNotify, httpHandler.handleNotify))))
+	router.POST(prefix+"/notify/batch", wrap(instrumented(metrics.NotifyRequests)(httpHandler.throttled(endpointNotify, httpHandler.handleNotifyBatch))))
+	router.POST(prefix+"/notify/pushkeys", wrap(instrumented(metrics.NotifyRequests)(httpHandler.throttled(endpointNotify, httpHandler.handleNotifyPushKeys))))
+	router.POST(prefix+"/ox", wrap(instrumented(metrics.NotifyRequests)(httpHandler.throttled(endpointNotify, httpHandler.handleOxNotify))))
+	router.POST(prefix+"/webpush/register", wrap(instrumented(metrics.RegisterRequests)(httpHandler.throttled(endpointRegister, httpHandler.handleWebPushRegister))))
+	router.GET(prefix+"/webpush/vapidkey", wrap(httpHandler.handleVapidKey))
+	router.POST(prefix+"/unifiedpush/register", wrap(instrumented(metrics.RegisterRequests)(httpHandler.throttled(endpointRegister, httpHandler.handleUnifiedPushRegister))))
+	httpHandler.registerUnregisterRoutes(router, prefix, func(handle httprouter.Handle) httprouter.Handle {
+		return wrap(instrumented(metrics.UnregisterRequests)(handle))
+	})
+}
+
 // Handle the REGISTER command. It looks as follows:
 //
 //	REGISTER aps-account-id="AAA" aps-device-token="BBB"
@@ -67,43 +138,114 @@ func NewHttpSocket(config *config.Config, db *database.Database, apns *Apns) {
 // the certificate issued by OS X Server for email push
 // notifications.
 func (httpHandler *httpHandler) handleRegister(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
 	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
 
 	reg := Register{}
 
-	err := json.NewDecoder(request.Body).Decode(&reg)
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&reg)
 	if err != nil {
-		log.Errorf("Error while handling register call: %s", err)
-		writer.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Error while handling register call: %s", err)
+		if status := decodeStatus(err); status != http.StatusBadRequest {
+			writeDecodeError(writer, request, err)
+			return
+		}
+		writeViolations(writer, request, []Violation{{Message: err.Error()}})
 		return
 	}
 
-	log.Debugf("Received Registration: %s", reg)
+	logger.Debugf("Received Registration: %s", reg)
 
-	if reg.checkParams() {
-		log.Errorf("Incomplete register payload: %v", reg)
-		writer.WriteHeader(http.StatusBadRequest)
+	result := httpHandler.register(logger, reg)
+	switch result.status {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		writeViolations(writer, request, result.violations)
+		return
+	case http.StatusTooManyRequests:
+		tooManyRequests(writer, request, result.retryAfter)
+		return
+	default:
+		writeError(writer, request, result.status, errorInternal, "could not store the registration")
 		return
 	}
 
-	// Make sure the subtopic is ok
-	if reg.ApsSubtopic != "com.apple.mobilemail" {
-		log.Errorf("Unknown aps-subtopic: %s", reg.ApsSubtopic)
-		writer.WriteHeader(http.StatusBadRequest)
+	logger.Debugf("handle() Register replying to dovecot plugin with: %s", result.topic)
+
+	if isVersioned(request) {
+		writeJson(writer, http.StatusOK, RegisterResponse{Topic: result.topic})
 		return
 	}
+	writer.Write([]byte(result.topic))
+}
 
-	// Register this email/account-id/device-token combination
-	err = httpHandler.db.AddRegistration(strings.ToLower(reg.Username), reg.ApsAccountId, reg.ApsDeviceToken, reg.Mailboxes)
+// registerResult is the outcome of a registration
+type registerResult struct {
+	status int
+	// the topic of the certificate the device has to listen to
+	topic string
+	// the invalid fields of a rejected registration
+	violations []Violation
+	// the time to wait if the user is throttled
+	retryAfter time.Duration
+}
+
+// register validates and stores the registration
+func (httpHandler *httpHandler) register(logger *log.Entry, reg Register) registerResult {
+	if violations := reg.validate(); len(violations) > 0 {
+		logViolations(logger, "register", violations)
+		return registerResult{status: http.StatusBadRequest, violations: violations}
+	}
+	apns := httpHandler.subtopicApns(reg.ApsSubtopic)
+	if apns == nil {
+		logger.Errorf("Registration for %s without a configured certificate", reg.ApsSubtopic)
+		violations := []Violation{{Field: "ApsSubtopic", Message: "no certificate configured for " + reg.ApsSubtopic}}
+		return registerResult{status: http.StatusBadRequest, violations: violations}
+	}
+
+	username, err := httpHandler.usernames.Canonicalize(reg.Username)
 	if err != nil {
-		log.Errorf("Failed to register client:: %s", err)
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
+		logger.Errorf("Invalid username in register payload: %s", err)
+		return registerResult{status: http.StatusBadRequest, violations: []Violation{{Field: "Username", Message: err.Error()}}}
 	}
 
-	log.Debugf("handle() Register replying to dovecot plugin with: %s", httpHandler.apns.Topic)
+	if ok, retryAfter := httpHandler.limiter.allowUser(endpointRegister, username); !ok {
+		logger.Warnf("Throttling registration of %s for %s", username, retryAfter)
+		return registerResult{status: http.StatusTooManyRequests, retryAfter: retryAfter}
+	}
 
-	writer.Write([]byte(httpHandler.apns.Topic))
+	// Register this email/account-id/device-token combination
+	if reg.ApsSubtopic == subtopicMail {
+		err = httpHandler.db.AddRegistration(username, reg.ApsAccountId, reg.ApsDeviceToken, reg.Mailboxes)
+	} else {
+		err = httpHandler.db.AddPushKeyRegistration(apns.Backend(), username, reg.ApsAccountId, reg.ApsDeviceToken, reg.PushKeys)
+	}
+	if errors.Is(err, database.ErrBackendConflict) {
+		logger.Warnf("Account %s of %s is registered for another subtopic", reg.ApsAccountId, username)
+		return registerResult{status: http.StatusBadRequest, violations: []Violation{{Field: "ApsAccountId", Message: "registered for another subtopic"}}}
+	}
+	if err != nil {
+		logger.Errorf("Failed to register client:: %s", err)
+		return registerResult{status: http.StatusInternalServerError}
+	}
+	return registerResult{status: http.StatusOK, topic: apns.topic()}
+}
+
+// subtopicApns returns the notifier of the subtopic or nil if its
+// certificate isn't configured
+func (httpHandler *httpHandler) subtopicApns(subtopic string) *Apns {
+	if subtopic == subtopicMail {
+		return httpHandler.apns
+	}
+	notifier, ok := httpHandler.dispatcher.Notifier(subtopicBackends[subtopic])
+	if !ok {
+		return nil
+	}
+	apns, _ := notifier.(*Apns)
+	return apns
 }
 
 // Handle the NOTIFY command. It looks as follows:
@@ -118,109 +260,192 @@ func (httpHandler *httpHandler) handleRegister(writer http.ResponseWriter, reque
 //
 //	{ "aps": { "account-id": aps-account-id } }
 func (httpHandler *httpHandler) handleNotify(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
 	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
 
 	notify := Notify{}
 	err := json.NewDecoder(request.Body).Decode(&notify)
 	if err != nil {
-		log.Errorf("Error while handling notify call: %s", err)
-		writer.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Error while handling notify call: %s", err)
+		writeDecodeError(writer, request, err)
 		return
 	}
 
-	if notify.checkParams() {
-		log.Errorf("Incomplete register payload: %v", notify)
-		writer.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// Dovecot supports case sensitive usernames, but postfix doesn't
-	// So we only care about lowercase users for now
-	// This isn't an exploit either, since we don't send any email contents via push
-	notify.Username = strings.ToLower(notify.Username)
+	results := httpHandler.notify(logger, []Notify{notify})
+	writeNotifyResult(writer, request, results[0])
+}
 
-	isMessageNew := false
-	// check if this is an event for a new message
-	// for all possible events have a look at dovecot-core:
-	// grep '#define EVENT_NAME' src/plugins/push-notification/push-notification-event*
-	for _, e := range notify.Events {
-		if e == "MessageNew" {
-			isMessageNew = true
+// writeNotifyResult replies with the result of a single notification,
+// the versioned API returns the NotifyResult on success
+func writeNotifyResult(writer http.ResponseWriter, request *http.Request, result NotifyResult) {
+	switch result.Status {
+	case http.StatusOK:
+		if isVersioned(request) {
+			writeJson(writer, http.StatusOK, result)
+			return
 		}
-	}
-
-	// we don't know how to handle other mailboxes other than INBOX, so ignore them
-	if notify.Mailbox != "INBOX" {
-		log.Debugln("Ignoring non INBOX event for:", notify.Mailbox)
 		writer.WriteHeader(http.StatusOK)
-		return
+	case http.StatusBadRequest:
+		writeError(writer, request, http.StatusBadRequest, errorInvalidNotification, "invalid notification")
+	case http.StatusNotFound:
+		writeError(writer, request, http.StatusNotFound, errorUnknownUser, "no registration found for "+result.Username)
+	case http.StatusTooManyRequests:
+		writer.Header().Set("Retry-After", strconv.Itoa(result.RetryAfter))
+		writeError(writer, request, http.StatusTooManyRequests, errorRateLimited, "retry after "+strconv.Itoa(result.RetryAfter)+" seconds")
+	default:
+		writer.WriteHeader(result.Status)
 	}
+}
+
+// Handle multiple notifications in one request, e.g. when a message is
+// delivered to many local recipients. The body is a JSON array of Notify
+// objects, the response contains a NotifyResult for each of them in the
+// same order.
+func (httpHandler *httpHandler) handleNotifyBatch(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
+	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
 
-	// Find all the devices registered for this mailbox event
-	registrations, err := httpHandler.db.FindRegistrations(notify.Username, notify.Mailbox)
+	var notifies []Notify
+	err := json.NewDecoder(request.Body).Decode(&notifies)
 	if err != nil {
-		log.Errorf("Cannot lookup registrations: %s", err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		logger.Errorf("Error while handling batch notify call: %s", err)
+		writeDecodeError(writer, request, err)
+		return
+	}
+	if len(notifies) == 0 {
+		logger.Error("Empty batch notify request")
+		writeError(writer, request, http.StatusBadRequest, errorInvalidRequest, "empty batch")
 		return
 	}
 
-	for _, r := range registrations {
-		log.Debugf("Found registration %s with token %s for username: %s", r.AccountId, r.DeviceToken, notify.Username)
+	writeJson(writer, http.StatusOK, httpHandler.notify(logger, notifies))
+}
+
+// notify resolves the registrations of all notifications in one pass and
+// sends each affected registration a single push. The push is sent with
+// the most urgent action of all notifications for the registration.
+func (httpHandler *httpHandler) notify(logger *log.Entry, notifies []Notify) []NotifyResult {
+	results := make([]NotifyResult, len(notifies))
+	decisions := make([]eventAction, len(notifies))
+	var lookups []database.Lookup
+	var lookupIndexes []int
+	for i := range notifies {
+		notify := &notifies[i]
+		results[i] = NotifyResult{Username: notify.Username, Mailbox: notify.Mailbox}
+		if notify.checkParams(logger) {
+			logger.Errorf("Incomplete notify payload: %v", notify)
+			results[i].Status = http.StatusBadRequest
+			continue
+		}
+
+		// This isn't an exploit even for a lax canonicalization,
+		// since we don't send any email contents via push
+		username, err := httpHandler.usernames.Canonicalize(notify.Username)
+		if err != nil {
+			logger.Errorf("Invalid username in notify payload: %s", err)
+			results[i].Status = http.StatusBadRequest
+			continue
+		}
+		notify.Username = username
+		results[i].Username = notify.Username
+
+		if ok, retryAfter := httpHandler.limiter.allowUser(endpointNotify, username); !ok {
+			logger.Warnf("Throttling notification of %s for %s", username, retryAfter)
+			results[i].Status = http.StatusTooManyRequests
+			results[i].RetryAfter = retryAfterSeconds(retryAfter)
+			continue
+		}
+
+		// decide how to handle the events, for all possible events have a look at dovecot-core:
+		// grep '#define EVENT_NAME' src/plugins/push-notification/push-notification-event*
+		decisions[i] = httpHandler.policy.decide(notify.Mailbox, notify.Events)
+		if decisions[i].action == actionIgnore {
+			logger.Debugln("Ignoring events", notify.Events, "for:", notify.Mailbox)
+			results[i].Status = http.StatusOK
+			continue
+		}
+
+		lookups = append(lookups, database.Lookup{Username: notify.Username, Mailbox: notify.Mailbox})
+		lookupIndexes = append(lookupIndexes, i)
 	}
-	if len(registrations) == 0 {
-		if httpHandler.db.UserExists(notify.Username) {
-			// This isn't an error as registrations are also empty if the mailbox doesn't match
-			log.Infof("No registered mailbox found for username: %s", notify.Username)
-			writer.WriteHeader(http.StatusNoContent)
-		} else {
-			log.Warnf("No registration found for username: %s", notify.Username)
-			writer.WriteHeader(http.StatusNotFound)
+
+	// Find all the devices registered for the mailbox events
+	decided := make(map[database.Registration]eventAction)
+	var registrations []database.Registration
+	for j, found := range httpHandler.db.FindRegistrationsBatch(lookups) {
+		i := lookupIndexes[j]
+		for _, r := range found.Registrations {
+			logger.Debugf("Found registration %s with token %s for username: %s", r.AccountId, r.DeviceToken, notifies[i].Username)
+		}
+		results[i].Registrations = len(found.Registrations)
+		if len(found.Registrations) == 0 {
+			if found.UserExists {
+				// This isn't an error as registrations are also empty if the mailbox doesn't match
+				logger.Infof("No registered mailbox found for username: %s", notifies[i].Username)
+				results[i].Status = http.StatusNoContent
+			} else {
+				logger.Warnf("No registration found for username: %s", notifies[i].Username)
+				results[i].Status = http.StatusNotFound
+			}
+			continue
+		}
+		results[i].Status = http.StatusOK
+
+		// deduplicate registrations notified by multiple items
+		for _, registration := range found.Registrations {
+			decision, seen := decided[registration]
+			if !seen {
+				registrations = append(registrations, registration)
+				decision = decisions[i]
+			}
+			decided[registration] = moreUrgent(decision, decisions[i])
 		}
-		return
 	}
 
-	// Send a notification to all registered devices. We ignore failures
-	// because there is not a lot we can do.
+	// Send a notification to all registered devices by the notifier of
+	// their backend. Failures are retried by the dispatcher.
 	for _, registration := range registrations {
-		httpHandler.apns.SendNotification(registration, !isMessageNew)
+		httpHandler.dispatcher.SendNotification(logger, registration, decided[registration].delay)
 	}
+	return results
+}
 
-	writer.WriteHeader(http.StatusOK)
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
 }
 
-func (reg *Register) checkParams() (isError bool) {
-	// Make sure we got the required parameters
-	if len(reg.ApsAccountId) == 0 {
-		log.Error("Missing aps-account-id in register request")
-		isError = true
-	}
-	if len(reg.ApsDeviceToken) == 0 {
-		log.Error("Missing aps-device-token in register request")
-		isError = true
-	}
-	if len(reg.Username) == 0 {
-		log.Error("Missing dovecot-username in register request")
-		isError = true
-	}
-	if len(reg.Mailboxes) == 0 {
-		log.Error("Missing dovecot-mailboxes in register request")
-		isError = true
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// instrumented returns a wrapper counting the requests handled by their status code
+func instrumented(counter *prometheus.CounterVec) func(httprouter.Handle) httprouter.Handle {
+	return func(handle httprouter.Handle) httprouter.Handle {
+		return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+			recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+			handle(recorder, request, params)
+			counter.WithLabelValues(strconv.Itoa(recorder.status)).Inc()
+		}
 	}
-	return
 }
 
-func (notify *Notify) checkParams() (isError bool) {
+func (notify *Notify) checkParams(logger *log.Entry) (isError bool) {
 	// Make sure we got the required parameters
 	if len(notify.Username) == 0 {
-		log.Error("Missing username in notify request")
+		logger.Error("Missing username in notify request")
 		isError = true
 	}
 	if len(notify.Mailbox) == 0 {
-		log.Error("Missing mailbox in notify request")
+		logger.Error("Missing mailbox in notify request")
 		isError = true
 	}
 	if len(notify.Events) == 0 {
-		log.Error("Missing register in notify request")
+		logger.Error("Missing register in notify request")
 		isError = true
 	}
 	return
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// AccountResponse contains the account id to unregister a subscription
+type AccountResponse struct {
+	AccountId string
+}
+
+// endpointAccountId derives a stable account id from the endpoint of a subscription
+func endpointAccountId(backend, endpoint string) string {
+	hash := sha256.Sum256([]byte(endpoint))
+	return backend + "-" + hex.EncodeToString(hash[:16])
+}
+
+// decodeSubscription reads the body of a subscription request into reg and
+// replies to requests that could not be decoded
+func decodeSubscription(writer http.ResponseWriter, request *http.Request, name string, reg interface{}) bool {
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(reg); err != nil {
+		requestLogger(request).Errorf("Error while handling %s call: %s", name, err)
+		if decodeStatus(err) != http.StatusBadRequest {
+			writeDecodeError(writer, request, err)
+			return false
+		}
+		writeViolations(writer, request, []Violation{{Message: err.Error()}})
+		return false
+	}
+	return true
+}
+
+// storeSubscription registers the endpoint of a validated subscription for
+// the mailboxes of the user and replies with its account id
+func (httpHandler *httpHandler) storeSubscription(writer http.ResponseWriter, request *http.Request, backend, username string, mailboxes []string, endpoint string, keys map[string]string) {
+	logger := requestLogger(request)
+	username, err := httpHandler.usernames.Canonicalize(username)
+	if err != nil {
+		logger.Errorf("Invalid username in %s subscription: %s", backend, err)
+		writeViolations(writer, request, []Violation{{Field: "Username", Message: err.Error()}})
+		return
+	}
+	if ok, retryAfter := httpHandler.limiter.allowUser(endpointRegister, username); !ok {
+		logger.Warnf("Throttling %s subscription of %s for %s", backend, username, retryAfter)
+		tooManyRequests(writer, request, retryAfter)
+		return
+	}
+
+	accountId := endpointAccountId(backend, endpoint)
+	if err := httpHandler.db.AddBackendRegistration(backend, username, accountId, endpoint, mailboxes, keys); err != nil {
+		logger.Errorf("Failed to register %s subscription: %s", backend, err)
+		writeError(writer, request, http.StatusInternalServerError, errorInternal, "could not store the registration")
+		return
+	}
+	logger.Debugln("Registered", backend, "subscription", accountId, "for", username)
+	writeJson(writer, http.StatusOK, AccountResponse{AccountId: accountId})
+}
@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// default interval to check the TLS files for changes
+	defaultTlsReloadInterval = time.Minute
+)
+
+var tlsVersions = map[string]uint16{
+	// an unquoted 1.0 in the config file is read as the number 1
+	"1":   tls.VersionTLS10,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsReloader holds the server certificate and the client CA pool of the
+// HTTPS socket and replaces them whenever one of the underlying files changes.
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	// nil if client certificates are not verified
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func newTlsReloader(certFile, keyFile, caFile string) (*tlsReloader, error) {
+	reloader := &tlsReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTimes: make(map[string]time.Time),
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *tlsReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if reloader.caFile != "" {
+		caData, err := os.ReadFile(reloader.caFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("no certificates found in %s", reloader.caFile)
+		}
+	}
+
+	reloader.mutex.Lock()
+	reloader.cert = &cert
+	reloader.clientCAs = clientCAs
+	reloader.modTimes = modTimes
+	reloader.mutex.Unlock()
+	return nil
+}
+
+func (reloader *tlsReloader) files() []string {
+	files := []string{reloader.certFile, reloader.keyFile}
+	if reloader.caFile != "" {
+		files = append(files, reloader.caFile)
+	}
+	return files
+}
+
+// changed reports whether any of the files has been modified since the last load
+func (reloader *tlsReloader) changed() bool {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// a missing file is reported by load()
+			return true
+		}
+		if !info.ModTime().Equal(reloader.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reloader *tlsReloader) createReloadThread(interval time.Duration) {
+	reloadTicker := time.NewTicker(interval)
+	go func() {
+		for range reloadTicker.C {
+			if !reloader.changed() {
+				continue
+			}
+			log.Infoln("TLS files changed, reloading", strings.Join(reloader.files(), ", "))
+			if err := reloader.load(); err != nil {
+				// keep serving with the old certificates
+				log.Errorln("Could not reload TLS files:", err)
+			}
+		}
+	}()
+}
+
+func (reloader *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.cert, nil
+}
+
+func (reloader *tlsReloader) getClientCAs() *x509.CertPool {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.clientCAs
+}
+
+// newTlsConfig creates the configuration of the HTTPS socket including the
+// optional verification of client certificates.
+func newTlsConfig(cfg *config.Config) (*tls.Config, error) {
+	reloader, err := newTlsReloader(cfg.TlsCertfile, cfg.TlsKeyfile, cfg.TlsClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+		// set explicitly since the config returned by GetConfigForClient
+		// doesn't inherit the protocols added by the http.Server
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if cfg.TlsMinVersion != "" {
+		version, ok := tlsVersions[cfg.TlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %s", cfg.TlsMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(cfg.TlsCipherSuites) > 0 {
+		tlsConfig.CipherSuites, err = cipherSuitesFromNames(cfg.TlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.TlsClientCAFile != "" {
+		log.Infoln("Client certificates of the HTTPS socket are verified against", cfg.TlsClientCAFile)
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.VerifyConnection = clientCertificateVerifier(cfg.TlsAllowedSubjects, cfg.TlsAllowedSANs)
+		// the CA pool may change at runtime, so hand out a fresh config per connection
+		baseConfig := tlsConfig.Clone()
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := baseConfig.Clone()
+			clientConfig.ClientCAs = reloader.getClientCAs()
+			return clientConfig, nil
+		}
+	} else if len(cfg.TlsAllowedSubjects) > 0 || len(cfg.TlsAllowedSANs) > 0 {
+		return nil, errors.New("tlsAllowedSubjects and tlsAllowedSANs require tlsClientCAFile to be set")
+	}
+
+	interval := time.Second * time.Duration(cfg.TlsReloadInterval)
+	if interval == 0 {
+		interval = defaultTlsReloadInterval
+	}
+	reloader.createReloadThread(interval)
+	return tlsConfig, nil
+}
+
+func cipherSuitesFromNames(names []string) ([]uint16, error) {
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// clientCertificateVerifier checks the already verified client certificate
+// against the allowed subjects and subject alternative names.
+func clientCertificateVerifier(allowedSubjects, allowedSANs []string) func(tls.ConnectionState) error {
+	if len(allowedSubjects) == 0 && len(allowedSANs) == 0 {
+		return nil
+	}
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("no client certificate presented")
+		}
+		cert := state.PeerCertificates[0]
+		for _, subject := range allowedSubjects {
+			if cert.Subject.CommonName == subject {
+				return nil
+			}
+		}
+		for _, san := range certificateSANs(cert) {
+			for _, allowed := range allowedSANs {
+				if san == allowed {
+					return nil
+				}
+			}
+		}
+		log.Warnf("Rejecting client certificate with subject %s", cert.Subject)
+		return fmt.Errorf("client certificate %s is not allowed", cert.Subject)
+	}
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+// testCertificate is a certificate and its key written as PEM files
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCertificate creates a certificate for template signed by parent,
+// it is self-signed if parent is nil
+func newTestCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *testCertificate) testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal("Cannot create certificate", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Cannot parse certificate", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal("Cannot marshal key", err)
+	}
+	certificate := testCertificate{cert, key, filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")}
+	writePem(t, certificate.certFile, "CERTIFICATE", der)
+	writePem(t, certificate.keyFile, "PRIVATE KEY", keyDer)
+	return certificate
+}
+
+func writePem(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (certificate testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{certificate.cert.Raw}, PrivateKey: certificate.key}
+}
+
+// serveTls serves an empty response with the TLS configuration of cfg
+func serveTls(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	tlsConfig, err := newTlsConfig(cfg)
+	if err != nil {
+		t.Fatal("Cannot setup TLS", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+	go server.Serve(tls.NewListener(listener, tlsConfig))
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// dialTls returns the certificate presented by the server or the handshake error
+func dialTls(addr string, roots *x509.CertPool, client *testCertificate) (*x509.Certificate, error) {
+	clientConfig := &tls.Config{ServerName: "localhost", RootCAs: roots}
+	if client != nil {
+		// present the certificate even if the server doesn't accept its CA
+		certificate := client.tlsCertificate()
+		clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &certificate, nil
+		}
+	}
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// client certificates are verified after the handshake of the client completed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTls_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "xapsd test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCertificate(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	clientUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	bySubject := newTestCertificate(t, dir, "dovecot", &x509.Certificate{Subject: pkix.Name{CommonName: "dovecot"}, ExtKeyUsage: clientUsage}, &ca)
+	bySan := newTestCertificate(t, dir, "proxy", &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}, DNSNames: []string{"proxy.example.org"}, ExtKeyUsage: clientUsage}, &ca)
+	notAllowed := newTestCertificate(t, dir, "other", &x509.Certificate{Subject: pkix.Name{CommonName: "other"}, ExtKeyUsage: clientUsage}, &ca)
+	otherCa := newTestCertificate(t, dir, "otherca", &x509.Certificate{Subject: pkix.Name{CommonName: "dovecot"}, ExtKeyUsage: clientUsage}, nil)
+
+	addr := serveTls(t, &config.Config{
+		TlsCertfile:        server.certFile,
+		TlsKeyfile:         server.keyFile,
+		TlsClientCAFile:    ca.certFile,
+		TlsAllowedSubjects: []string{"dovecot"},
+		TlsAllowedSANs:     []string{"proxy.example.org"},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, test := range []struct {
+		name     string
+		client   *testCertificate
+		accepted bool
+	}{
+		{"allowed subject", &bySubject, true},
+		{"allowed SAN", &bySan, true},
+		{"subject not allowed", &notAllowed, false},
+		{"unknown CA", &otherCa, false},
+		{"no certificate", nil, false},
+	} {
+		_, err := dialTls(addr, roots, test.client)
+		if test.accepted && err != nil {
+			t.Errorf("%s: client rejected: %s", test.name, err)
+		}
+		if !test.accepted && err == nil {
+			t.Errorf("%s: client accepted", test.name)
+		}
+	}
+}
+
+func TestTls_Reload(t *testing.T) {
+	dir := t.TempDir()
+	template := func() *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}, DNSNames: []string{"localhost"}}
+	}
+	first := newTestCertificate(t, dir, "server", template(), nil)
+	addr := serveTls(t, &config.Config{TlsCertfile: first.certFile, TlsKeyfile: first.keyFile, TlsReloadInterval: 1})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first.cert)
+	served, err := dialTls(addr, roots, nil)
+	if err != nil || !served.Equal(first.cert) {
+		t.Fatal("First certificate not served", err)
+	}
+
+	// replace the files in place like certbot does
+	second := newTestCertificate(t, dir, "server", template(), nil)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{second.certFile, second.keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots.AddCert(second.cert)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		served, err = dialTls(addr, roots, nil)
+		if err == nil && served.Equal(second.cert) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("Reloaded certificate not served", err)
+}
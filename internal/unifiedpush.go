@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const backendUnifiedPush = "unifiedpush"
+
+// UnifiedPush is the Notifier posting notifications to the endpoints of
+// UnifiedPush distributors like ntfy, used by Android mail clients
+type UnifiedPush struct {
+	// hosts endpoints may point to
+	allowedHosts []string
+	// schemes of the endpoints, https unless unifiedPushAllowHttp is set
+	schemes []string
+	client  *http.Client
+	pushRecorder
+}
+
+// UnifiedPushRegister is posted to /unifiedpush/register by mail clients
+type UnifiedPushRegister struct {
+	Username  string
+	Mailboxes []string
+	// URL of the distributor the notifications are posted to
+	Endpoint string
+}
+
+func NewUnifiedPush(cfg *config.Config) *UnifiedPush {
+	unifiedPush := &UnifiedPush{
+		allowedHosts: cfg.UnifiedPushAllowedHosts,
+		schemes:      []string{"https"},
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	if cfg.UnifiedPushAllowHttp {
+		unifiedPush.schemes = append(unifiedPush.schemes, "http")
+	}
+	return unifiedPush
+}
+
+// Backend implements Notifier
+func (unifiedPush *UnifiedPush) Backend() string {
+	return backendUnifiedPush
+}
+
+// Push posts the account id of the registration to its endpoint
+func (unifiedPush *UnifiedPush) Push(logger *log.Entry, registration database.Registration) (PushOutcome, error) {
+	logger.Debugln("Sending UnifiedPush notification to", registration.AccountId, "/", registration.DeviceToken)
+	payload, _ := json.Marshal(map[string]string{"AccountId": registration.AccountId})
+	request, err := http.NewRequest(http.MethodPost, registration.DeviceToken, bytes.NewReader(payload))
+	if err != nil {
+		return unifiedPush.recordStatus(backendUnifiedPush, PushOutcome{Error: err.Error()}), fmt.Errorf("%w: %s", errGone, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Urgency", "high")
+
+	res, err := unifiedPush.client.Do(request)
+	if err != nil {
+		return unifiedPush.recordStatus(backendUnifiedPush, PushOutcome{Error: err.Error()}), retryable(err)
+	}
+	defer res.Body.Close()
+	reason, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	outcome := unifiedPush.recordStatus(backendUnifiedPush, PushOutcome{
+		StatusCode: res.StatusCode,
+		Reason:     strings.TrimSpace(string(reason)),
+	})
+	if res.StatusCode < http.StatusMultipleChoices {
+		logger.Debugln("Distributor returned", res.StatusCode, "for notification to", registration.AccountId)
+		return outcome, nil
+	}
+	return outcome, statusError(res.StatusCode, outcome.Reason)
+}
+
+// validate checks the registration and returns every violation, the
+// endpoint has to point to one of the allowed hosts
+func (reg *UnifiedPushRegister) validate(allowedHosts, schemes []string) []Violation {
+	violations := subscriberViolations(reg.Username, reg.Mailboxes)
+	endpointViolations := endpointViolations("Endpoint", reg.Endpoint, schemes...)
+	if len(endpointViolations) == 0 {
+		if endpoint, _ := url.Parse(reg.Endpoint); !slices.Contains(allowedHosts, endpoint.Hostname()) {
+			endpointViolations = []Violation{{"Endpoint", "host is not allowed"}}
+		}
+	}
+	return append(violations, endpointViolations...)
+}
+
+// unifiedPush returns the UnifiedPush notifier if it is enabled
+func (httpHandler *httpHandler) unifiedPush() (*UnifiedPush, bool) {
+	notifier, ok := httpHandler.dispatcher.Notifier(backendUnifiedPush)
+	if !ok {
+		return nil, false
+	}
+	unifiedPush, ok := notifier.(*UnifiedPush)
+	return unifiedPush, ok
+}
+
+// Handle a UnifiedPush registration of a mail client. The body contains
+// the username, the mailboxes to watch and the endpoint assigned by the
+// distributor. The response contains the account id of the registration.
+func (httpHandler *httpHandler) handleUnifiedPushRegister(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
+	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
+
+	unifiedPush, ok := httpHandler.unifiedPush()
+	if !ok {
+		writeError(writer, request, http.StatusNotFound, errorNotFound, "UnifiedPush is not enabled")
+		return
+	}
+
+	reg := UnifiedPushRegister{}
+	if !decodeSubscription(writer, request, "UnifiedPush register", &reg) {
+		return
+	}
+	if violations := reg.validate(unifiedPush.allowedHosts, unifiedPush.schemes); len(violations) > 0 {
+		logViolations(logger, "UnifiedPush register", violations)
+		writeViolations(writer, request, violations)
+		return
+	}
+	httpHandler.storeSubscription(writer, request, backendUnifiedPush, reg.Username, reg.Mailboxes, reg.Endpoint, nil)
+}
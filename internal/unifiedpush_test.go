@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
+	"github.com/freswa/dovecot-xaps-daemon/internal/username"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUnifiedPush(t *testing.T) {
+	status := http.StatusOK
+	var reason string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ = io.ReadAll(request.Body)
+		writer.WriteHeader(status)
+		io.WriteString(writer, reason)
+	}))
+	defer server.Close()
+
+	dispatcher := newTestDispatcher(t)
+	// the test server doesn't use TLS
+	dispatcher.Register(NewUnifiedPush(&config.Config{UnifiedPushAllowedHosts: []string{"127.0.0.1"}, UnifiedPushAllowHttp: true}))
+	usernames, err := username.NewCanonicalizer(&config.Config{})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer", err)
+	}
+	handler := &httpHandler{db: dispatcher.db, dispatcher: dispatcher, maxBodyBytes: 4096, usernames: usernames}
+	router := httprouter.New()
+	handler.registerRoutes(router, apiPrefix, versioned)
+
+	register := func(endpoint string) *httptest.ResponseRecorder {
+		reg, _ := json.Marshal(UnifiedPushRegister{Username: "stefan", Mailboxes: []string{"INBOX"}, Endpoint: endpoint})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, apiPrefix+"/unifiedpush/register", strings.NewReader(string(reg))))
+		return recorder
+	}
+
+	if recorder := register("https://ntfy.example.org/upAbc"); recorder.Code != http.StatusBadRequest {
+		t.Error("Endpoint of a host not allowed accepted:", recorder.Code)
+	}
+	recorder := register(server.URL + "/upAbc")
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Registration failed:", recorder.Code, recorder.Body)
+	}
+	var response AccountResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if !strings.HasPrefix(response.AccountId, backendUnifiedPush+"-") {
+		t.Error("Unexpected account id", response.AccountId)
+	}
+
+	registrations, _ := dispatcher.db.FindRegistrations("stefan", "INBOX")
+	if len(registrations) != 1 || registrations[0].Backend != backendUnifiedPush {
+		t.Fatal("Unexpected registrations", registrations)
+	}
+	if _, err := dispatcher.Push(newRequestLogger("test"), registrations[0]); err != nil {
+		t.Fatal("Push failed", err)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(body, &payload); err != nil || payload["AccountId"] != response.AccountId {
+		t.Error("Unexpected payload", string(body), err)
+	}
+
+	// the body chosen by the distributor is not used as label
+	status, reason = http.StatusTeapot, "reason chosen by the distributor"
+	series := testutil.CollectAndCount(metrics.Pushes)
+	if outcome, _ := dispatcher.Push(newRequestLogger("test"), registrations[0]); outcome.Reason != reason {
+		t.Error("Unexpected reason", outcome.Reason)
+	}
+	if testutil.CollectAndCount(metrics.Pushes) != series+1 || testutil.ToFloat64(metrics.Pushes.WithLabelValues(backendUnifiedPush, "418", "")) != 1 {
+		t.Error("Reason of the distributor used as label")
+	}
+
+	// another user registered the same endpoint
+	if err := dispatcher.db.AddBackendRegistration(backendUnifiedPush, "alice", response.AccountId, server.URL+"/upAbc", []string{"INBOX"}, nil); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	status, reason = http.StatusNotFound, ""
+	dispatcher.Push(newRequestLogger("test"), registrations[0])
+	if registrations, _ := dispatcher.db.FindRegistrations("stefan", "INBOX"); len(registrations) != 0 {
+		t.Error("Gone registration has not been deleted", registrations)
+	}
+	if registrations, _ := dispatcher.db.FindRegistrations("alice", "INBOX"); len(registrations) != 1 {
+		t.Error("Registration of another user has been deleted", registrations)
+	}
+}
+
+func TestUnifiedPush_Validate(t *testing.T) {
+	unifiedPush := NewUnifiedPush(&config.Config{UnifiedPushAllowedHosts: []string{"ntfy.sh"}})
+	reg := UnifiedPushRegister{Username: "stefan", Mailboxes: []string{"INBOX"}, Endpoint: "https://ntfy.sh/upAbc"}
+	if violations := reg.validate(unifiedPush.allowedHosts, unifiedPush.schemes); len(violations) != 0 {
+		t.Error("Valid registration rejected:", violations)
+	}
+	for _, endpoint := range []string{
+		"",
+		"ftp://ntfy.sh/upAbc",
+		"http://ntfy.sh/upAbc",
+		"https:///upAbc",
+		"https://ntfy.example.org/upAbc",
+		"https://ntfy.sh/" + strings.Repeat("a", maxEndpointLength),
+	} {
+		reg.Endpoint = endpoint
+		if violations := reg.validate(unifiedPush.allowedHosts, unifiedPush.schemes); len(violations) != 1 || violations[0].Field != "Endpoint" {
+			t.Errorf("Expected a violation of the endpoint %q, got %v", endpoint, violations)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// registerUnregisterRoutes adds the routes to remove registrations:
+//
+//	DELETE /users/:username                       remove all accounts of a user
+//	DELETE /users/:username/accounts/:accountid   remove a single account
+//	DELETE /devices/:token                        remove all accounts of a device token
+//
+// Each route replies 204 if registrations were removed and 404 otherwise.
+func (httpHandler *httpHandler) registerUnregisterRoutes(router *httprouter.Router, prefix string, wrap func(httprouter.Handle) httprouter.Handle) {
+	router.DELETE(prefix+"/users/:username", wrap(httpHandler.handleUnregisterUser))
+	router.DELETE(prefix+"/users/:username/accounts/:accountid", wrap(httpHandler.handleUnregisterAccount))
+	router.DELETE(prefix+"/devices/:token", wrap(httpHandler.handleUnregisterDevice))
+}
+
+func (httpHandler *httpHandler) handleUnregisterUser(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	logger := requestLogger(request)
+	username, err := httpHandler.usernames.Canonicalize(params.ByName("username"))
+	if err != nil {
+		logger.Errorf("Invalid username in unregister request: %s", err)
+		writeError(writer, request, http.StatusBadRequest, errorInvalidUsername, err.Error())
+		return
+	}
+	registrations := httpHandler.db.DeleteUser(username)
+	httpHandler.unregistered(writer, request, registrations)
+}
+
+func (httpHandler *httpHandler) handleUnregisterAccount(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	logger := requestLogger(request)
+	username, err := httpHandler.usernames.Canonicalize(params.ByName("username"))
+	if err != nil {
+		logger.Errorf("Invalid username in unregister request: %s", err)
+		writeError(writer, request, http.StatusBadRequest, errorInvalidUsername, err.Error())
+		return
+	}
+	var registrations []database.Registration
+	registration, ok := httpHandler.db.DeleteRegistration(username, params.ByName("accountid"))
+	if ok {
+		registrations = append(registrations, registration)
+	}
+	httpHandler.unregistered(writer, request, registrations)
+}
+
+func (httpHandler *httpHandler) handleUnregisterDevice(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	registrations := httpHandler.db.DeleteDeviceToken(params.ByName("token"))
+	httpHandler.unregistered(writer, request, registrations)
+}
+
+// unregistered drops delayed notifications of the removed registrations and replies
+func (httpHandler *httpHandler) unregistered(writer http.ResponseWriter, request *http.Request, registrations []database.Registration) {
+	if len(registrations) == 0 {
+		writeError(writer, request, http.StatusNotFound, errorNotFound, "no registrations found")
+		return
+	}
+	httpHandler.dispatcher.Forget(registrations)
+	requestLogger(request).Infoln("Unregistered", len(registrations), "accounts")
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+)
+
+func TestUnregister(t *testing.T) {
+	router, handler := newApiTestHandler(t)
+	notifier := &testNotifier{backend: database.DefaultBackend}
+	handler.dispatcher.Register(notifier)
+	for _, reg := range []struct{ username, accountId, token string }{
+		{"stefan", "account1", "token1"},
+		{"stefan", "account2", "token2"},
+		{"alice", "account3", "token3"},
+		{"bob", "account4", "token3"},
+	} {
+		if err := handler.db.AddRegistration(reg.username, reg.accountId, reg.token, []string{"INBOX"}); err != nil {
+			t.Fatal("Cannot add registration", err)
+		}
+	}
+	// queue a delayed notification for every registration
+	for _, username := range []string{"stefan", "alice", "bob"} {
+		registrations, _ := handler.db.FindRegistrations(username, "INBOX")
+		for _, registration := range registrations {
+			handler.dispatcher.SendNotification(newRequestLogger("test"), registration, time.Hour)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+		queued int
+	}{
+		{"/v1/users/stefan/accounts/account1", http.StatusNoContent, 3},
+		{"/v1/users/stefan/accounts/account1", http.StatusNotFound, 3},
+		{"/v1/users/nobody/accounts/account2", http.StatusNotFound, 3},
+		{"/v1/users/stefan", http.StatusNoContent, 2},
+		{"/v1/users/stefan", http.StatusNotFound, 2},
+		{"/v1/devices/token3", http.StatusNoContent, 0},
+		{"/v1/devices/token3", http.StatusNotFound, 0},
+	} {
+		recorder := serve(router, http.MethodDelete, test.path, "")
+		if recorder.Code != test.status {
+			t.Errorf("DELETE %s: expected %d, got %d", test.path, test.status, recorder.Code)
+		}
+		if queued := handler.dispatcher.QueueSize(); queued != test.queued {
+			t.Errorf("DELETE %s: expected %d queued notifications, got %d", test.path, test.queued, queued)
+		}
+	}
+
+	if handler.db.UserExists("stefan") || handler.db.UserExists("alice") || handler.db.UserExists("bob") {
+		t.Error("Unregistered users still exist")
+	}
+	if len(notifier.pushed) != 0 {
+		t.Error("Dropped notifications have been sent", notifier.pushed)
+	}
+}
@@ -0,0 +1,225 @@
+// Package username maps the usernames received from Dovecot and the
+// registering devices onto the canonical name used as database key.
+package username
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	DomainKeep   = "keep"
+	DomainStrip  = "strip"
+	DomainAppend = "append"
+
+	// interval to check the alias file for changes
+	aliasReloadInterval = time.Minute
+)
+
+// Canonicalizer normalizes usernames in the following order:
+//
+//  1. surrounding whitespace is removed
+//  2. the name is lowercased, or case folded and NFC normalized if caseFolding is enabled
+//  3. the domain is converted to its ASCII form if idna is enabled
+//  4. the default domain is stripped from or appended to the name
+//  5. aliases are replaced by their target
+type Canonicalizer struct {
+	caseFolding   bool
+	idna          bool
+	defaultDomain string
+	domainMode    string
+	aliasFile     string
+	aliasMutex    sync.RWMutex
+	aliases       map[string]string
+	aliasModTime  time.Time
+}
+
+// NewCanonicalizer creates a Canonicalizer and loads the alias file
+func NewCanonicalizer(cfg *config.Config) (*Canonicalizer, error) {
+	canonicalizer := &Canonicalizer{
+		caseFolding: cfg.UsernameCaseFolding,
+		idna:        cfg.UsernameIdna,
+		domainMode:  strings.ToLower(cfg.UsernameDomainMode),
+		aliasFile:   cfg.UsernameAliasFile,
+		aliases:     make(map[string]string),
+	}
+	if canonicalizer.domainMode == "" {
+		canonicalizer.domainMode = DomainKeep
+	}
+	switch canonicalizer.domainMode {
+	case DomainKeep:
+	case DomainStrip, DomainAppend:
+		if cfg.UsernameDefaultDomain == "" {
+			return nil, fmt.Errorf("usernameDomainMode %s requires usernameDefaultDomain", canonicalizer.domainMode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown usernameDomainMode %s", cfg.UsernameDomainMode)
+	}
+	if cfg.UsernameDefaultDomain != "" {
+		domain, err := canonicalizer.normalizeDomain(canonicalizer.fold(cfg.UsernameDefaultDomain))
+		if err != nil {
+			return nil, fmt.Errorf("invalid usernameDefaultDomain: %w", err)
+		}
+		canonicalizer.defaultDomain = domain
+	}
+	if canonicalizer.aliasFile != "" {
+		if err := canonicalizer.loadAliases(); err != nil {
+			return nil, err
+		}
+		canonicalizer.createAliasReloadThread()
+	}
+	return canonicalizer, nil
+}
+
+// Canonicalize returns the canonical form of the username
+func (canonicalizer *Canonicalizer) Canonicalize(username string) (string, error) {
+	name, err := canonicalizer.normalize(username)
+	if err != nil {
+		return "", err
+	}
+	canonicalizer.aliasMutex.RLock()
+	target, ok := canonicalizer.aliases[name]
+	canonicalizer.aliasMutex.RUnlock()
+	if ok {
+		log.Debugf("Username %s is an alias of %s", name, target)
+		return target, nil
+	}
+	return name, nil
+}
+
+// normalize applies all steps besides the alias lookup
+func (canonicalizer *Canonicalizer) normalize(username string) (string, error) {
+	name := canonicalizer.fold(strings.TrimSpace(username))
+	if name == "" {
+		return "", fmt.Errorf("empty username")
+	}
+
+	local, domain, hasDomain := cutDomain(name)
+	if hasDomain {
+		var err error
+		domain, err = canonicalizer.normalizeDomain(domain)
+		if err != nil {
+			return "", fmt.Errorf("invalid domain in username %s: %w", username, err)
+		}
+	}
+
+	switch {
+	case canonicalizer.domainMode == DomainStrip && hasDomain && domain == canonicalizer.defaultDomain:
+		return local, nil
+	case canonicalizer.domainMode == DomainAppend && !hasDomain:
+		return local + "@" + canonicalizer.defaultDomain, nil
+	case hasDomain:
+		return local + "@" + domain, nil
+	default:
+		return local, nil
+	}
+}
+
+func (canonicalizer *Canonicalizer) fold(name string) string {
+	if canonicalizer.caseFolding {
+		return norm.NFC.String(cases.Fold().String(name))
+	}
+	// Dovecot supports case sensitive usernames, but postfix doesn't
+	// So we only care about lowercase users
+	return strings.ToLower(name)
+}
+
+func (canonicalizer *Canonicalizer) normalizeDomain(domain string) (string, error) {
+	if !canonicalizer.idna {
+		return domain, nil
+	}
+	return idna.Lookup.ToASCII(domain)
+}
+
+// cutDomain splits the name at the last @
+func cutDomain(name string) (string, string, bool) {
+	i := strings.LastIndex(name, "@")
+	if i == -1 {
+		return name, "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// loadAliases reads the alias file. Each line maps an alias to a username:
+//
+//	# comment
+//	john.doe@example.org: jdoe
+//
+// Both sides are normalized like every other username.
+func (canonicalizer *Canonicalizer) loadAliases() error {
+	info, err := os.Stat(canonicalizer.aliasFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(canonicalizer.aliasFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	aliases := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		alias, target, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected \"alias: username\"", canonicalizer.aliasFile, lineNumber)
+		}
+		alias, err = canonicalizer.normalize(alias)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", canonicalizer.aliasFile, lineNumber, err)
+		}
+		target, err = canonicalizer.normalize(target)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", canonicalizer.aliasFile, lineNumber, err)
+		}
+		aliases[alias] = target
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	canonicalizer.aliasMutex.Lock()
+	canonicalizer.aliases = aliases
+	canonicalizer.aliasModTime = info.ModTime()
+	canonicalizer.aliasMutex.Unlock()
+	log.Debugln("Loaded", len(aliases), "aliases from", canonicalizer.aliasFile)
+	return nil
+}
+
+func (canonicalizer *Canonicalizer) createAliasReloadThread() {
+	aliasReloadTicker := time.NewTicker(aliasReloadInterval)
+	go func() {
+		for range aliasReloadTicker.C {
+			info, err := os.Stat(canonicalizer.aliasFile)
+			if err != nil {
+				log.Errorln("Could not check alias file:", err)
+				continue
+			}
+			canonicalizer.aliasMutex.RLock()
+			changed := !info.ModTime().Equal(canonicalizer.aliasModTime)
+			canonicalizer.aliasMutex.RUnlock()
+			if !changed {
+				continue
+			}
+			log.Infoln("Alias file changed, reloading", canonicalizer.aliasFile)
+			if err := canonicalizer.loadAliases(); err != nil {
+				// keep the old aliases
+				log.Errorln("Could not reload alias file:", err)
+			}
+		}
+	}()
+}
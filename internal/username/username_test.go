@@ -0,0 +1,78 @@
+package username
+
+import (
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+)
+
+func TestCanonicalizer_Default(t *testing.T) {
+	canonicalizer, err := NewCanonicalizer(&config.Config{})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer:", err)
+	}
+
+	for input, expected := range map[string]string{
+		"Stefan":               "stefan",
+		" stefan@Example.org ": "stefan@example.org",
+		"STRASSE@bücher.de":    "strasse@bücher.de",
+	} {
+		if name, err := canonicalizer.Canonicalize(input); err != nil || name != expected {
+			t.Errorf("Canonicalize(%q) = %q, %v, expected %q", input, name, err, expected)
+		}
+	}
+
+	if _, err := canonicalizer.Canonicalize("  "); err == nil {
+		t.Error("Empty username has been accepted")
+	}
+}
+
+func TestCanonicalizer_Pipeline(t *testing.T) {
+	canonicalizer, err := NewCanonicalizer(&config.Config{
+		UsernameCaseFolding:   true,
+		UsernameIdna:          true,
+		UsernameDefaultDomain: "Example.org",
+		UsernameDomainMode:    DomainStrip,
+		UsernameAliasFile:     "testdata/aliases",
+	})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer:", err)
+	}
+
+	for input, expected := range map[string]string{
+		"Stefan@EXAMPLE.org":      "stefan",
+		"stefan@other.org":        "stefan@other.org",
+		"STRASSE@Bücher.de":       "strasse@xn--bcher-kva.de",
+		"Straße@xn--bcher-kva.de": "strasse@xn--bcher-kva.de",
+		"john.doe@example.org":    "jdoe",
+		"JOHN.DOE":                "jdoe",
+		"postmaster":              "admin",
+	} {
+		if name, err := canonicalizer.Canonicalize(input); err != nil || name != expected {
+			t.Errorf("Canonicalize(%q) = %q, %v, expected %q", input, name, err, expected)
+		}
+	}
+}
+
+func TestCanonicalizer_Append(t *testing.T) {
+	canonicalizer, err := NewCanonicalizer(&config.Config{
+		UsernameDefaultDomain: "example.org",
+		UsernameDomainMode:    DomainAppend,
+	})
+	if err != nil {
+		t.Fatal("Cannot create canonicalizer:", err)
+	}
+
+	for input, expected := range map[string]string{
+		"stefan":           "stefan@example.org",
+		"stefan@other.org": "stefan@other.org",
+	} {
+		if name, err := canonicalizer.Canonicalize(input); err != nil || name != expected {
+			t.Errorf("Canonicalize(%q) = %q, %v, expected %q", input, name, err, expected)
+		}
+	}
+
+	if _, err := NewCanonicalizer(&config.Config{UsernameDomainMode: DomainAppend}); err == nil {
+		t.Error("Domain mode append without default domain has been accepted")
+	}
+}
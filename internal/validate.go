@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// APNs device tokens are 32 bytes, newer devices may use longer ones
+	minDeviceTokenLength = 64
+	maxDeviceTokenLength = 200
+	maxAccountIdLength   = 128
+	maxUsernameLength    = 255
+	maxMailboxes         = 500
+	maxMailboxLength     = 1024
+	maxEndpointLength    = 1024
+
+	subtopicMail     = "com.apple.mobilemail"
+	subtopicCalendar = "com.apple.calendar"
+	subtopicContacts = "com.apple.contact"
+)
+
+// Violation describes an invalid field of a request
+type Violation struct {
+	Field   string
+	Message string
+}
+
+// ValidationErrors is the body of a 400 response to an invalid registration
+type ValidationErrors struct {
+	Violations []Violation
+}
+
+// validate checks all fields of the registration and returns every violation
+func (reg *Register) validate() []Violation {
+	var violations []Violation
+	add := func(field, format string, args ...interface{}) {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case reg.ApsDeviceToken == "":
+		add("ApsDeviceToken", "missing")
+	case len(reg.ApsDeviceToken) < minDeviceTokenLength || len(reg.ApsDeviceToken) > maxDeviceTokenLength:
+		add("ApsDeviceToken", "length must be between %d and %d", minDeviceTokenLength, maxDeviceTokenLength)
+	case !isHex(reg.ApsDeviceToken):
+		add("ApsDeviceToken", "must be hexadecimal")
+	}
+
+	switch {
+	case reg.ApsAccountId == "":
+		add("ApsAccountId", "missing")
+	case len(reg.ApsAccountId) > maxAccountIdLength:
+		add("ApsAccountId", "longer than %d characters", maxAccountIdLength)
+	case !isAccountId(reg.ApsAccountId):
+		add("ApsAccountId", "may only contain letters, digits, '-', '_' and '.'")
+	}
+
+	switch reg.ApsSubtopic {
+	case subtopicMail:
+		violations = append(violations, subscriberViolations(reg.Username, reg.Mailboxes)...)
+		if len(reg.PushKeys) > 0 {
+			add("PushKeys", "only allowed for %s and %s", subtopicCalendar, subtopicContacts)
+		}
+	case subtopicCalendar, subtopicContacts:
+		// calendars and address books are identified by their push keys
+		violations = append(violations, usernameViolations(reg.Username)...)
+		violations = append(violations, namesViolations("PushKeys", reg.PushKeys)...)
+		if len(reg.Mailboxes) > 0 {
+			add("Mailboxes", "only allowed for %s", subtopicMail)
+		}
+	default:
+		add("ApsSubtopic", "must be one of %s, %s or %s", subtopicMail, subtopicCalendar, subtopicContacts)
+		violations = append(violations, subscriberViolations(reg.Username, reg.Mailboxes)...)
+	}
+	return violations
+}
+
+// subscriberViolations checks the username and the mailboxes of a registration
+func subscriberViolations(username string, mailboxes []string) []Violation {
+	return append(usernameViolations(username), namesViolations("Mailboxes", mailboxes)...)
+}
+
+func usernameViolations(username string) []Violation {
+	var violations []Violation
+	add := func(field, format string, args ...interface{}) {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case username == "":
+		add("Username", "missing")
+	case len(username) > maxUsernameLength:
+		add("Username", "longer than %d bytes", maxUsernameLength)
+	case !isPrintable(username):
+		add("Username", "must be printable UTF-8")
+	}
+	return violations
+}
+
+// namesViolations checks a list of mailboxes or push keys
+func namesViolations(field string, names []string) []Violation {
+	var violations []Violation
+	add := func(field, format string, args ...interface{}) {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case len(names) == 0:
+		add(field, "missing")
+	case len(names) > maxMailboxes:
+		add(field, "more than %d entries", maxMailboxes)
+	default:
+		for i, name := range names {
+			field := fmt.Sprintf("%s[%d]", field, i)
+			switch {
+			case name == "":
+				add(field, "empty")
+			case len(name) > maxMailboxLength:
+				add(field, "longer than %d bytes", maxMailboxLength)
+			case !isPrintable(name):
+				add(field, "must be printable UTF-8")
+			}
+		}
+	}
+	return violations
+}
+
+// endpointViolations checks the URL a push service is reached at
+func endpointViolations(field, endpoint string, schemes ...string) []Violation {
+	endpointUrl, err := url.Parse(endpoint)
+	switch {
+	case endpoint == "":
+		return []Violation{{field, "missing"}}
+	case len(endpoint) > maxEndpointLength:
+		return []Violation{{field, fmt.Sprintf("longer than %d bytes", maxEndpointLength)}}
+	case err != nil || !slices.Contains(schemes, endpointUrl.Scheme) || endpointUrl.Host == "":
+		return []Violation{{field, fmt.Sprintf("must be a %s URL", strings.Join(schemes, " or "))}}
+	}
+	return nil
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// isAccountId accepts the UUIDs sent by iOS and similar ids
+func isAccountId(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func isPrintable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		if !unicode.IsPrint(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// logViolations logs each violation of the request
+func logViolations(logger *log.Entry, request string, violations []Violation) {
+	for _, violation := range violations {
+		logger.Errorf("Invalid %s in %s request: %s", violation.Field, request, violation.Message)
+	}
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func validRegister() Register {
+	return Register{
+		ApsAccountId:   "9B5A4D0C-3E0B-4F0D-8B48-6A0B3D1E4C2F",
+		ApsDeviceToken: strings.Repeat("0123456789abcdef", 4),
+		ApsSubtopic:    "com.apple.mobilemail",
+		Username:       "stefan@example.org",
+		Mailboxes:      []string{"INBOX", "Sent Messages"},
+	}
+}
+
+func TestValidate_Register(t *testing.T) {
+	reg := validRegister()
+	if violations := reg.validate(); len(violations) != 0 {
+		t.Error("Valid registration rejected:", violations)
+	}
+
+	for _, test := range []struct {
+		field  string
+		modify func(reg *Register)
+	}{
+		{"ApsDeviceToken", func(reg *Register) { reg.ApsDeviceToken = "" }},
+		{"ApsDeviceToken", func(reg *Register) { reg.ApsDeviceToken = "0123456789abcdef" }},
+		{"ApsDeviceToken", func(reg *Register) { reg.ApsDeviceToken = strings.Repeat("x", 64) }},
+		{"ApsAccountId", func(reg *Register) { reg.ApsAccountId = `AAA","aps":{"alert":"hi"}` }},
+		{"ApsAccountId", func(reg *Register) { reg.ApsAccountId = strings.Repeat("A", maxAccountIdLength+1) }},
+		{"ApsSubtopic", func(reg *Register) { reg.ApsSubtopic = "com.apple.notes" }},
+		{"PushKeys", func(reg *Register) { reg.PushKeys = []string{"abc"} }},
+		{"Mailboxes", func(reg *Register) { reg.ApsSubtopic, reg.PushKeys = subtopicCalendar, []string{"abc"} }},
+		{"PushKeys[1]", func(reg *Register) {
+			reg.ApsSubtopic, reg.Mailboxes, reg.PushKeys = subtopicContacts, nil, []string{"abc", ""}
+		}},
+		{"Username", func(reg *Register) { reg.Username = strings.Repeat("a", maxUsernameLength+1) }},
+		{"Username", func(reg *Register) { reg.Username = "ste\nfan" }},
+		{"Mailboxes", func(reg *Register) { reg.Mailboxes = nil }},
+		{"Mailboxes", func(reg *Register) { reg.Mailboxes = make([]string, maxMailboxes+1) }},
+		{"Mailboxes[1]", func(reg *Register) { reg.Mailboxes[1] = "" }},
+		{"Mailboxes[1]", func(reg *Register) { reg.Mailboxes[1] = strings.Repeat("a", maxMailboxLength+1) }},
+		{"Mailboxes[1]", func(reg *Register) { reg.Mailboxes[1] = "\xff" }},
+	} {
+		reg := validRegister()
+		test.modify(&reg)
+		violations := reg.validate()
+		if len(violations) != 1 || violations[0].Field != test.field {
+			t.Errorf("Expected a violation of %s, got %v", test.field, violations)
+		}
+	}
+
+	reg = validRegister()
+	reg.ApsSubtopic, reg.Mailboxes, reg.PushKeys = subtopicCalendar, nil, []string{"/calendars/__uids__/stefan/calendar/"}
+	if violations := reg.validate(); len(violations) != 0 {
+		t.Error("Valid calendar registration rejected:", violations)
+	}
+
+	if violations := (&Register{}).validate(); len(violations) != 5 {
+		t.Error("Expected all violations of an empty registration, got", violations)
+	}
+}
+
+func TestValidate_UnknownField(t *testing.T) {
+	handler := &httpHandler{maxBodyBytes: 1024}
+	request := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"ApsAccountId":"AAA","Foo":1}`))
+	recorder := httptest.NewRecorder()
+	handler.handleRegister(recorder, request, nil)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), `unknown field \"Foo\"`) {
+		t.Error("Unknown field not reported:", recorder.Body.String())
+	}
+}
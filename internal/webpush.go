@@ -0,0 +1,438 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	backendWebPush = "webpush"
+
+	// names of the subscription keys stored in the account
+	keyP256dh = "p256dh"
+	keyAuth   = "auth"
+
+	defaultWebPushTtl = 24 * 60 * 60
+	// validity of the VAPID token, at most 24 hours are allowed
+	vapidExpiry = 12 * time.Hour
+	// record size of the encrypted content
+	webPushRecordSize = 4096
+	authSecretLength  = 16
+)
+
+var (
+	errNonPublicAddress = errors.New("endpoint is not a public address")
+	// carrier-grade NAT, not covered by netip.Addr.IsPrivate
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// WebPush is the Notifier sending encrypted notifications to the push
+// services of browsers (RFC 8030) with VAPID authentication (RFC 8292).
+type WebPush struct {
+	db         *database.Database
+	privateKey *ecdsa.PrivateKey
+	// PublicKey is the base64url encoded application server key used by
+	// browsers to subscribe
+	PublicKey string
+	subject   string
+	ttl       uint
+	client    *http.Client
+	pushRecorder
+}
+
+// WebPushSubscription is the JSON representation of a browser PushSubscription
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// WebPushRegister is posted to /webpush/register by webmail clients
+type WebPushRegister struct {
+	Username     string
+	Mailboxes    []string
+	Subscription WebPushSubscription
+}
+
+// VapidKeyResponse contains the application server key for PushManager.subscribe()
+type VapidKeyResponse struct {
+	PublicKey string
+}
+
+// NewWebPush loads the VAPID key, a new key is generated if the file doesn't exist
+func NewWebPush(cfg *config.Config, db *database.Database) (*WebPush, error) {
+	if cfg.WebPushVapidSubject == "" {
+		return nil, errors.New("webPushVapidSubject is required, e.g. mailto:postmaster@example.org")
+	}
+	privateKey, err := loadVapidKey(cfg.WebPushVapidKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := privateKey.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	webPush := &WebPush{
+		db:         db,
+		privateKey: privateKey,
+		PublicKey:  base64.RawURLEncoding.EncodeToString(publicKey.Bytes()),
+		subject:    cfg.WebPushVapidSubject,
+		ttl:        cfg.WebPushTtl,
+		client:     newPublicClient(),
+	}
+	if webPush.ttl == 0 {
+		webPush.ttl = defaultWebPushTtl
+	}
+	log.Infoln("Web Push VAPID public key is", webPush.PublicKey)
+	return webPush, nil
+}
+
+func loadVapidKey(filename string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		log.Infoln("Generating VAPID key", filename)
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		return privateKey, os.WriteFile(filename, data, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		key, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, err
+		}
+		var ok bool
+		if privateKey, ok = key.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("VAPID key in %s is not an EC key", filename)
+		}
+	}
+	if privateKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("VAPID key in %s is not a P-256 key", filename)
+	}
+	return privateKey, nil
+}
+
+// Backend implements Notifier
+func (webPush *WebPush) Backend() string {
+	return backendWebPush
+}
+
+// Push encrypts the notification for the subscription and posts it to its endpoint
+func (webPush *WebPush) Push(logger *log.Entry, registration database.Registration) (PushOutcome, error) {
+	logger.Debugln("Sending web push notification to", registration.AccountId, "/", registration.DeviceToken)
+	account, ok := webPush.db.FindAccount(registration.Username, registration.AccountId)
+	if !ok {
+		return webPush.recordStatus(backendWebPush, PushOutcome{Error: "unknown account"}), errGone
+	}
+	payload, _ := json.Marshal(map[string]string{"AccountId": registration.AccountId})
+	body, err := encryptWebPush(payload, account.Keys[keyP256dh], account.Keys[keyAuth])
+	if err != nil {
+		// the subscription has been validated on registration
+		return webPush.recordStatus(backendWebPush, PushOutcome{Error: err.Error()}), fmt.Errorf("%w: %s", errGone, err)
+	}
+	authorization, err := webPush.vapidAuthorization(registration.DeviceToken)
+	if err != nil {
+		return webPush.recordStatus(backendWebPush, PushOutcome{Error: err.Error()}), err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, registration.DeviceToken, bytes.NewReader(body))
+	if err != nil {
+		return webPush.recordStatus(backendWebPush, PushOutcome{Error: err.Error()}), fmt.Errorf("%w: %s", errGone, err)
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("TTL", strconv.FormatUint(uint64(webPush.ttl), 10))
+	request.Header.Set("Urgency", "high")
+	request.Header.Set("Authorization", authorization)
+
+	res, err := webPush.client.Do(request)
+	if errors.Is(err, errNonPublicAddress) {
+		// the endpoint won't become reachable, the subscription is removed
+		return webPush.recordStatus(backendWebPush, PushOutcome{Error: err.Error()}), fmt.Errorf("%w: %s", errGone, err)
+	}
+	if err != nil {
+		return webPush.recordStatus(backendWebPush, PushOutcome{Error: err.Error()}), retryable(err)
+	}
+	defer res.Body.Close()
+	reason, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	outcome := webPush.recordStatus(backendWebPush, PushOutcome{
+		StatusCode: res.StatusCode,
+		Reason:     strings.TrimSpace(string(reason)),
+		Id:         res.Header.Get("Location"),
+	})
+	if res.StatusCode < http.StatusMultipleChoices {
+		logger.Debugln("Push service returned", res.StatusCode, "for notification to", registration.AccountId)
+		return outcome, nil
+	}
+	return outcome, statusError(res.StatusCode, outcome.Reason)
+}
+
+// newPublicClient returns a client connecting only to public addresses.
+// The endpoints of Web Push subscriptions are chosen by the clients of the
+// plugin socket, they must not make xapsd post to internal services.
+func newPublicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect to the endpoint instead of the checked dialer
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
+// dialPublicOnly refuses to connect to addresses not routed on the
+// internet. It checks the resolved address, so host names resolving to
+// internal addresses are refused too.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(ip) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, ip)
+	}
+	return nil
+}
+
+// isPublicAddr rejects loopback, private, link-local, shared (RFC 6598)
+// and other special addresses
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// vapidAuthorization returns the Authorization header for the origin of the endpoint (RFC 8292)
+func (webPush *WebPush) vapidAuthorization(endpoint string) (string, error) {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": endpointUrl.Scheme + "://" + endpointUrl.Host,
+		"exp": time.Now().Add(vapidExpiry).Unix(),
+		"sub": webPush.subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, webPush.privateKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS uses the fixed size concatenation of r and s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + webPush.PublicKey, nil
+}
+
+// encryptWebPush encrypts the payload as a single aes128gcm record (RFC 8291)
+func encryptWebPush(payload []byte, p256dh, auth string) ([]byte, error) {
+	uaPublicBytes, err := decodeBase64(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh: %w", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh: %w", err)
+	}
+	authSecret, err := decodeBase64(auth)
+	if err != nil || len(authSecret) != authSecretLength {
+		return nil, errors.New("invalid auth secret")
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWebPushRecord(payload, uaPublic, authSecret, asPrivate, salt)
+}
+
+// encryptWebPushRecord encrypts the payload with the given application
+// server key and salt, which are random for every notification
+func encryptWebPushRecord(payload []byte, uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	asPublic := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// combine the ECDH secret with the auth secret of the subscription
+	keyInfo := "WebPush: info\x00" + string(uaPublic.Bytes()) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// the padding delimiter of the last record
+	plaintext := append(append([]byte(nil), payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > webPushRecordSize {
+		return nil, errors.New("payload too large")
+	}
+
+	// header: salt, record size, key id length and the key id containing the public key
+	body := make([]byte, 0, 16+4+1+len(asPublic)+len(plaintext)+gcm.Overhead())
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, webPushRecordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	return gcm.Seal(body, nonce, plaintext, nil), nil
+}
+
+// decodeBase64 accepts the base64url encoding used by browsers with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// validate checks the subscription and returns every violation
+func (reg *WebPushRegister) validate() []Violation {
+	violations := subscriberViolations(reg.Username, reg.Mailboxes)
+	if endpointViolations := endpointViolations("Subscription.endpoint", reg.Subscription.Endpoint, "https"); len(endpointViolations) > 0 {
+		violations = append(violations, endpointViolations...)
+	} else if !isPublicHost(reg.Subscription.Endpoint) {
+		violations = append(violations, Violation{"Subscription.endpoint", "must not be a loopback, private or link-local address"})
+	}
+	if key, err := decodeBase64(reg.Subscription.Keys.P256dh); err != nil {
+		violations = append(violations, Violation{"Subscription.keys.p256dh", "must be base64url encoded"})
+	} else if _, err := ecdh.P256().NewPublicKey(key); err != nil {
+		violations = append(violations, Violation{"Subscription.keys.p256dh", "must be an uncompressed P-256 public key"})
+	}
+	if secret, err := decodeBase64(reg.Subscription.Keys.Auth); err != nil || len(secret) != authSecretLength {
+		violations = append(violations, Violation{"Subscription.keys.auth", fmt.Sprintf("must be %d base64url encoded bytes", authSecretLength)})
+	}
+	return violations
+}
+
+// isPublicHost rejects endpoints with an internal address or localhost as
+// host. Names resolving to internal addresses are refused when dialing.
+func isPublicHost(endpoint string) bool {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(endpointUrl.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err != nil || isPublicAddr(ip)
+}
+
+// webPush returns the Web Push notifier if it is enabled
+func (httpHandler *httpHandler) webPush() (*WebPush, bool) {
+	notifier, ok := httpHandler.dispatcher.Notifier(backendWebPush)
+	if !ok {
+		return nil, false
+	}
+	webPush, ok := notifier.(*WebPush)
+	return webPush, ok
+}
+
+// Handle a Web Push subscription of a webmail client. The body contains
+// the username, the mailboxes to watch and the PushSubscription of the
+// browser. The response contains the account id of the subscription.
+func (httpHandler *httpHandler) handleWebPushRegister(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	logger := requestLogger(request)
+	defer request.Body.Close()
+	limitBody(writer, request, httpHandler.maxBodyBytes)
+
+	if _, ok := httpHandler.webPush(); !ok {
+		writeError(writer, request, http.StatusNotFound, errorNotFound, "web push is not configured")
+		return
+	}
+
+	reg := WebPushRegister{}
+	if !decodeSubscription(writer, request, "web push register", &reg) {
+		return
+	}
+	if violations := reg.validate(); len(violations) > 0 {
+		logViolations(logger, "web push register", violations)
+		writeViolations(writer, request, violations)
+		return
+	}
+	keys := map[string]string{keyP256dh: reg.Subscription.Keys.P256dh, keyAuth: reg.Subscription.Keys.Auth}
+	httpHandler.storeSubscription(writer, request, backendWebPush, reg.Username, reg.Mailboxes, reg.Subscription.Endpoint, keys)
+}
+
+// Handle a request for the VAPID public key passed to PushManager.subscribe()
+func (httpHandler *httpHandler) handleVapidKey(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	webPush, ok := httpHandler.webPush()
+	if !ok {
+		writeError(writer, request, http.StatusNotFound, errorNotFound, "web push is not configured")
+		return
+	}
+	writeJson(writer, http.StatusOK, VapidKeyResponse{PublicKey: webPush.PublicKey})
+}
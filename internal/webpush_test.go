@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/freswa/dovecot-xaps-daemon/internal/config"
+	"github.com/freswa/dovecot-xaps-daemon/internal/database"
+	"github.com/freswa/dovecot-xaps-daemon/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testSubscription is the browser side of a subscription
+type testSubscription struct {
+	private *ecdh.PrivateKey
+	auth    []byte
+}
+
+func newTestSubscription(t *testing.T) *testSubscription {
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	auth := make([]byte, authSecretLength)
+	rand.Read(auth)
+	return &testSubscription{private, auth}
+}
+
+func (subscription *testSubscription) keys() (string, string) {
+	return base64.RawURLEncoding.EncodeToString(subscription.private.PublicKey().Bytes()),
+		base64.RawURLEncoding.EncodeToString(subscription.auth)
+}
+
+// decrypt reverses encryptWebPush like a browser does
+func (subscription *testSubscription) decrypt(t *testing.T, body []byte) []byte {
+	salt := body[:16]
+	if binary.BigEndian.Uint32(body[16:20]) != webPushRecordSize {
+		t.Fatal("Unexpected record size")
+	}
+	keyIdLength := int(body[20])
+	asPublicBytes := body[21 : 21+keyIdLength]
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal("Invalid key id", err)
+	}
+	ecdhSecret, _ := subscription.private.ECDH(asPublic)
+	keyInfo := "WebPush: info\x00" + string(subscription.private.PublicKey().Bytes()) + string(asPublicBytes)
+	ikm, _ := hkdf.Key(sha256.New, ecdhSecret, subscription.auth, keyInfo, 32)
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, body[21+keyIdLength:], nil)
+	if err != nil {
+		t.Fatal("Cannot decrypt", err)
+	}
+	if plaintext[len(plaintext)-1] != 0x02 {
+		t.Fatal("Missing padding delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+func TestWebPush_Encrypt(t *testing.T) {
+	subscription := newTestSubscription(t)
+	p256dh, auth := subscription.keys()
+
+	body, err := encryptWebPush([]byte("hello"), p256dh, auth)
+	if err != nil {
+		t.Fatal("Cannot encrypt", err)
+	}
+	if plaintext := subscription.decrypt(t, body); string(plaintext) != "hello" {
+		t.Errorf("Decrypted %q", plaintext)
+	}
+
+	if _, err := encryptWebPush([]byte("hello"), p256dh, "AAAA"); err == nil {
+		t.Error("Invalid auth secret accepted")
+	}
+}
+
+// TestWebPush_Rfc8291 checks the example of RFC 8291 Appendix A
+func TestWebPush_Rfc8291(t *testing.T) {
+	decode := func(s string) []byte {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal("Invalid test vector", err)
+		}
+		return data
+	}
+	asPrivate, err := ecdh.P256().NewPrivateKey(decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(decode("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := decode("BTBZMqHH6r4Tts7J_aSIgg")
+	salt := decode("DGv6ra1nlYgDCS1FRnbzlw")
+
+	body, err := encryptWebPushRecord([]byte("When I grow up, I want to be a watermelon"), uaPublic, authSecret, asPrivate, salt)
+	if err != nil {
+		t.Fatal("Cannot encrypt", err)
+	}
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if encoded := base64.RawURLEncoding.EncodeToString(body); encoded != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestWebPush_PublicAddress(t *testing.T) {
+	for _, test := range []struct {
+		endpoint string
+		public   bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"https://93.184.215.14/push", true},
+		{"https://[2001:4860:4860::8888]/push", true},
+		{"https://localhost/push", false},
+		{"https://push.localhost./push", false},
+		{"https://127.0.0.1:8443/push", false},
+		{"https://10.1.2.3/push", false},
+		{"https://192.168.0.1/push", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://100.64.0.1/push", false},
+		{"https://0.0.0.0/push", false},
+		{"https://[::1]/push", false},
+		{"https://[fe80::1]/push", false},
+		{"https://[fd00::1]/push", false},
+		{"https://[::ffff:127.0.0.1]/push", false},
+	} {
+		if public := isPublicHost(test.endpoint); public != test.public {
+			t.Errorf("%s: expected public %t, got %t", test.endpoint, test.public, public)
+		}
+	}
+}
+
+func TestWebPush_Push(t *testing.T) {
+	var status int
+	var reason string
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received = request
+		body, _ = io.ReadAll(request.Body)
+		writer.WriteHeader(status)
+		io.WriteString(writer, reason)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	db, err := database.NewDatabase(filepath.Join(dir, "database.json"))
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	keyFile := filepath.Join(dir, "vapid.pem")
+	webPush, err := NewWebPush(&config.Config{WebPushVapidKeyFile: keyFile, WebPushVapidSubject: "mailto:postmaster@example.org"}, db)
+	if err != nil {
+		t.Fatal("Cannot create web push", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("VAPID key has not been generated", err)
+	}
+	if reloaded, err := NewWebPush(&config.Config{WebPushVapidKeyFile: keyFile, WebPushVapidSubject: "mailto:x"}, db); err != nil || reloaded.PublicKey != webPush.PublicKey {
+		t.Error("VAPID key has not been reloaded", err)
+	}
+
+	subscription := newTestSubscription(t)
+	p256dh, auth := subscription.keys()
+	endpoint := server.URL + "/push/abc"
+	if err := db.AddBackendRegistration(backendWebPush, "stefan", "webpush-1", endpoint, []string{"INBOX"}, map[string]string{keyP256dh: p256dh, keyAuth: auth}); err != nil {
+		t.Fatal("Cannot add registration", err)
+	}
+	registrations, _ := db.FindRegistrations("stefan", "INBOX")
+
+	// the default client refuses the loopback address of the test server
+	status = http.StatusCreated
+	if _, err := webPush.Push(newRequestLogger("test"), registrations[0]); !errors.Is(err, errGone) || received != nil {
+		t.Fatal("Expected errGone for a loopback endpoint, got", err)
+	}
+	webPush.client = server.Client()
+
+	if _, err := webPush.Push(newRequestLogger("test"), registrations[0]); err != nil {
+		t.Fatal("Push failed", err)
+	}
+	if received.Header.Get("Content-Encoding") != "aes128gcm" || received.Header.Get("TTL") != "86400" {
+		t.Error("Missing headers", received.Header)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(subscription.decrypt(t, body), &payload); err != nil || payload["AccountId"] != "webpush-1" {
+		t.Error("Unexpected payload", payload, err)
+	}
+	verifyVapid(t, received.Header.Get("Authorization"), webPush.PublicKey, server.URL)
+
+	status = http.StatusGone
+	if _, err := webPush.Push(newRequestLogger("test"), registrations[0]); !errors.Is(err, errGone) {
+		t.Error("Expected errGone for 410, got", err)
+	}
+	status = http.StatusServiceUnavailable
+	if _, err := webPush.Push(newRequestLogger("test"), registrations[0]); !isRetryable(err) {
+		t.Error("Expected a retryable error for 503, got", err)
+	}
+
+	// the body chosen by the push service is not used as label
+	status, reason = http.StatusTeapot, "reason chosen by the push service"
+	series := testutil.CollectAndCount(metrics.Pushes)
+	outcome, _ := webPush.Push(newRequestLogger("test"), registrations[0])
+	if outcome.Reason != reason {
+		t.Error("Unexpected reason", outcome.Reason)
+	}
+	if testutil.CollectAndCount(metrics.Pushes) != series+1 || testutil.ToFloat64(metrics.Pushes.WithLabelValues(backendWebPush, "418", "")) != 1 {
+		t.Error("Reason of the push service used as label")
+	}
+}
+
+// verifyVapid checks the signature and the audience of the VAPID token
+func verifyVapid(t *testing.T, authorization, publicKey, audience string) {
+	token, key, ok := strings.Cut(strings.TrimPrefix(authorization, "vapid t="), ", k=")
+	if !ok || key != publicKey {
+		t.Fatal("Invalid authorization header", authorization)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal("Invalid token", token)
+	}
+	keyBytes, _ := base64.RawURLEncoding.DecodeString(key)
+	ecdsaKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), keyBytes)
+	if err != nil {
+		t.Fatal("Invalid public key", err)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(ecdsaKey, hash[:], r, s) {
+		t.Error("Invalid VAPID signature")
+	}
+	claimsJson, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	json.Unmarshal(claimsJson, &claims)
+	if claims["aud"] != audience || claims["sub"] != "mailto:postmaster@example.org" {
+		t.Error("Unexpected claims", claims)
+	}
+}
+
+func TestWebPush_Validate(t *testing.T) {
+	subscription := newTestSubscription(t)
+	reg := WebPushRegister{Username: "stefan", Mailboxes: []string{"INBOX"}}
+	reg.Subscription.Endpoint = "https://push.example.org/abc"
+	reg.Subscription.Keys.P256dh, reg.Subscription.Keys.Auth = subscription.keys()
+	if violations := reg.validate(); len(violations) != 0 {
+		t.Error("Valid subscription rejected:", violations)
+	}
+
+	reg.Subscription.Endpoint = "http://push.example.org/abc"
+	reg.Subscription.Keys.P256dh = "AAAA"
+	reg.Subscription.Keys.Auth = ""
+	reg.Mailboxes = nil
+	if violations := reg.validate(); len(violations) != 4 {
+		t.Error("Expected 4 violations, got", violations)
+	}
+
+	reg.Subscription.Endpoint = "https://169.254.169.254/latest/meta-data"
+	if violations := reg.validate(); len(violations) != 4 {
+		t.Error("Expected 4 violations, got", violations)
+	}
+}